@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// accessModeAllow only serves known clients: clients with a reservation or a listed hardware address.
+	accessModeAllow = "allow"
+	// accessModeDeny serves all clients, except clients with a listed hardware address.
+	accessModeDeny = "deny"
+
+	// accessActionIgnore ignores all messages of denied clients.
+	accessActionIgnore = "ignore"
+	// accessActionNAK answers requests of denied clients with a DHCPNAK.
+	accessActionNAK = "nak"
+)
+
+// AccessConfig holds the policy that decides which clients are served.
+type AccessConfig struct {
+	// Mode is "allow" (known clients only) or "deny"
+	Mode string `json:"mode"`
+	// MACs holds hardware addresses (e.g. "52:54:00:12:34:56") and OUI wildcards (e.g. "52:54:00:*").
+	MACs []string `json:"macs,omitempty"`
+	// Action taken on requests of denied clients, "ignore" (default) or "nak".
+	// Discovers of denied clients and requests addressed to other servers are always ignored.
+	Action string `json:"action,omitempty"`
+}
+
+// Validate changes the values in the given config.
+// Returns nil if all ok, otherwise an error.
+func (c *AccessConfig) Validate() error {
+	switch c.Mode {
+	case accessModeAllow, accessModeDeny:
+	default:
+		return maskAny(fmt.Errorf("Unknown access mode '%s'", c.Mode))
+	}
+	switch c.Action {
+	case "":
+		c.Action = accessActionIgnore
+	case accessActionIgnore, accessActionNAK:
+	default:
+		return maskAny(fmt.Errorf("Unknown access action '%s'", c.Action))
+	}
+	for i, pattern := range c.MACs {
+		normalized, err := normalizeMACPattern(pattern)
+		if err != nil {
+			return maskAny(err)
+		}
+		c.MACs[i] = normalized
+	}
+	return nil
+}
+
+// IsAllowed returns true if the client with given hardware address is served.
+// Known is set when the client has a reservation.
+func (c AccessConfig) IsAllowed(chAddr net.HardwareAddr, known bool) bool {
+	listed := c.isListed(chAddr)
+	if c.Mode == accessModeDeny {
+		return !listed
+	}
+	return known || listed
+}
+
+// isListed returns true if the given hardware address matches one of the listed addresses.
+func (c AccessConfig) isListed(chAddr net.HardwareAddr) bool {
+	mac := chAddr.String()
+	for _, pattern := range c.MACs {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(mac, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if mac == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMACPattern returns the given hardware address or wildcard in lowercase,
+// with all bytes written as 2 hex digits.
+func normalizeMACPattern(pattern string) (string, error) {
+	if !strings.HasSuffix(pattern, "*") {
+		mac, err := net.ParseMAC(pattern)
+		if err != nil {
+			return "", maskAny(fmt.Errorf("Failed to parse access mac '%s'", pattern))
+		}
+		return mac.String(), nil
+	}
+	prefix, err := parseHexBytes(strings.TrimSuffix(strings.TrimSuffix(pattern, "*"), ":"))
+	if err != nil {
+		return "", maskAny(fmt.Errorf("Failed to parse access mac '%s'", pattern))
+	}
+	return formatHexBytes(prefix) + ":*", nil
+}
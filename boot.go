@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const (
+	// ipxeUserClass is the user class (option 77) sent by iPXE.
+	ipxeUserClass = "iPXE"
+	// pxeVendorClassPrefix is the prefix of the vendor class (option 60) sent by PXE clients.
+	pxeVendorClassPrefix = "PXEClient"
+	// maxBootFilenameLength is the maximum length of a boot filename that fits in the file field.
+	maxBootFilenameLength = 127
+)
+
+// BootConfig holds the network boot (PXE) configuration.
+type BootConfig struct {
+	NextServer string `json:"next-server,omitempty"` // Address of the server to load the boot file from (siaddr)
+	TFTPServer string `json:"tftp-server,omitempty"` // Name of the TFTP server (option 66)
+	Filename   string `json:"filename,omitempty"`    // Default boot file (file & option 67)
+	// Architectures holds boot files for specific client architectures (option 93).
+	Architectures []ArchitectureBoot `json:"architectures,omitempty"`
+	// IPXEScript is the URL of the script given to iPXE clients, instead of a boot file.
+	IPXEScript string `json:"ipxe-script,omitempty"`
+}
+
+// ArchitectureBoot holds the boot file for a specific client architecture.
+// Common architectures are 0 (x86 BIOS), 6 (x86 UEFI), 7 & 9 (x64 UEFI) and 11 (ARM64 UEFI).
+type ArchitectureBoot struct {
+	Arch     int    `json:"arch"`     // Client system architecture (option 93)
+	Filename string `json:"filename"` // Boot file for this architecture
+}
+
+// Validate changes the values in the given boot config.
+// Returns nil if all ok, otherwise an error.
+func (b *BootConfig) Validate() error {
+	if b.NextServer != "" {
+		if ip := parseIP(b.NextServer); ip == nil || ip.To4() == nil {
+			return maskAny(fmt.Errorf("Failed to parse boot next-server '%s'", b.NextServer))
+		}
+	}
+	if len(b.Filename) > maxBootFilenameLength {
+		return maskAny(fmt.Errorf("Boot filename '%s' is too long", b.Filename))
+	}
+	if len(b.IPXEScript) > maxBootFilenameLength {
+		return maskAny(fmt.Errorf("Boot ipxe-script '%s' is too long", b.IPXEScript))
+	}
+	for _, a := range b.Architectures {
+		if a.Arch < 0 || a.Arch > 0xffff {
+			return maskAny(fmt.Errorf("Boot architecture out of range, got %d", a.Arch))
+		}
+		if a.Filename == "" {
+			return maskAny(fmt.Errorf("Boot architecture %d has no filename", a.Arch))
+		}
+		if len(a.Filename) > maxBootFilenameLength {
+			return maskAny(fmt.Errorf("Boot filename '%s' is too long", a.Filename))
+		}
+	}
+	return nil
+}
+
+// SelectFilename returns the boot file for the client that sent the given options.
+// iPXE clients get the iPXE script (if configured), other clients get the boot file
+// for their architecture, or the default boot file.
+func (b BootConfig) SelectFilename(options dhcp.Options) string {
+	if b.IPXEScript != "" && isIPXEClient(options) {
+		return b.IPXEScript
+	}
+	if data, ok := options[dhcp.OptionClientArchitecture]; ok {
+		// Option contains a list of 16-bit architecture types
+		for len(data) >= 2 {
+			arch := int(binary.BigEndian.Uint16(data))
+			for _, a := range b.Architectures {
+				if a.Arch == arch {
+					return a.Filename
+				}
+			}
+			data = data[2:]
+		}
+	}
+	return b.Filename
+}
+
+// isNetworkBootClient returns true if the given options were sent by a
+// client that is booting from the network.
+func isNetworkBootClient(options dhcp.Options) bool {
+	if _, ok := options[dhcp.OptionClientArchitecture]; ok {
+		return true
+	}
+	if strings.HasPrefix(string(options[dhcp.OptionVendorClassIdentifier]), pxeVendorClassPrefix) {
+		return true
+	}
+	return isIPXEClient(options)
+}
+
+// isIPXEClient returns true if the given options were sent by iPXE.
+func isIPXEClient(options dhcp.Options) bool {
+	for _, userClass := range userClasses(options) {
+		if userClass == ipxeUserClass {
+			return true
+		}
+	}
+	return false
+}
+
+// userClasses returns the user classes found in the user class option (77).
+// The option is formatted as a list of length prefixed strings (RFC 3004),
+// but some clients (such as iPXE) send a single plain string.
+func userClasses(options dhcp.Options) []string {
+	data, ok := options[dhcp.OptionUserClass]
+	if !ok || len(data) == 0 {
+		return nil
+	}
+	var result []string
+	for rest := data; len(rest) > 0; {
+		size := int(rest[0])
+		if size == 0 || len(rest) < 1+size {
+			// Not formatted according to RFC 3004
+			return []string{string(data)}
+		}
+		result = append(result, string(rest[1:1+size]))
+		rest = rest[1+size:]
+	}
+	return result
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// ClientClass is a named group of clients, such as IP phones or virtual machines.
+// A client is a member of every class it matches.
+// Classes can restrict the ranges a client can use and contribute options.
+type ClientClass struct {
+	Name  string     `json:"name"`
+	Match ClassMatch `json:"match"`
+	// Options of this class, overriding the options of the subnet and range.
+	// Network dependent options (subnet mask, routers and routes) are not allowed,
+	// since a class is used in all subnets.
+	Options DHCPOptions `json:"options,omitempty"`
+	// VendorOptions holds the sub-options of the vendor-specific information option (43)
+	// sent to members of this class. The class must match on vendor class, since the
+	// meaning of the sub-options is defined by the vendor.
+	VendorOptions []VendorSubOption `json:"vendor-options,omitempty"`
+}
+
+// Validate changes the values in the given class.
+// Returns nil if all ok, otherwise an error.
+func (c *ClientClass) Validate() error {
+	if c.Name == "" {
+		return maskAny(fmt.Errorf("Class must have a name"))
+	}
+	if err := c.Match.Validate(); err != nil {
+		return maskAny(fmt.Errorf("Class '%s': %v", c.Name, err))
+	}
+	if err := c.Options.Validate(); err != nil {
+		return maskAny(err)
+	}
+	if c.Options.SubnetMask != "" || len(c.Options.Routers) > 0 || len(c.Options.Routes) > 0 {
+		return maskAny(fmt.Errorf("Class '%s' cannot have subnet-mask, router or route options", c.Name))
+	}
+	for _, o := range c.Options.Custom {
+		if _, found := networkOptions[dhcp.OptionCode(o.Code)]; found {
+			return maskAny(fmt.Errorf("Class '%s' cannot have network dependent option %d", c.Name, o.Code))
+		}
+	}
+	if len(c.VendorOptions) > 0 {
+		if c.Match.VendorClass == "" {
+			return maskAny(fmt.Errorf("Class '%s' with vendor-options must match on vendor-class", c.Name))
+		}
+		if err := validateVendorSubOptions(c.VendorOptions); err != nil {
+			return maskAny(fmt.Errorf("Class '%s': %v", c.Name, err))
+		}
+	}
+	return nil
+}
+
+// networkOptions contains the options that depend on the network of the client.
+var networkOptions = map[dhcp.OptionCode]struct{}{
+	dhcp.OptionSubnetMask:        {},
+	dhcp.OptionRouter:            {},
+	dhcp.OptionBroadcastAddress:  {},
+	dhcp.OptionStaticRoute:       {},
+	optionClasslessStaticRoute:   {},
+	optionMSClasslessStaticRoute: {},
+}
+
+// ClassMatch holds the conditions a client must satisfy to be a member of a class.
+// All given conditions must be satisfied.
+// Vendor and user classes are matched as plain text, a trailing '*' matches any suffix.
+type ClassMatch struct {
+	VendorClass string          `json:"vendor-class,omitempty"` // Vendor class identifier (option 60), e.g. "PXEClient*"
+	UserClass   string          `json:"user-class,omitempty"`   // One of the user classes (option 77), e.g. "iPXE"
+	MACPrefix   string          `json:"mac-prefix,omitempty"`   // Prefix of the hardware address as colon separated hex bytes, e.g. "52:54:00"
+	RelayAgent  RelayAgentMatch `json:"relay-agent,omitempty"`  // Relay agent information (option 82)
+	Options     []OptionMatch   `json:"options,omitempty"`      // Values of arbitrary options
+}
+
+// Validate changes the values in the given match.
+// Returns nil if all ok, otherwise an error.
+func (m *ClassMatch) Validate() error {
+	if m.VendorClass == "" && m.UserClass == "" && m.MACPrefix == "" && m.RelayAgent.IsEmpty() && len(m.Options) == 0 {
+		return maskAny(fmt.Errorf("Match must have at least one condition"))
+	}
+	if m.MACPrefix != "" {
+		prefix, err := parseHexBytes(m.MACPrefix)
+		if err != nil {
+			return maskAny(fmt.Errorf("Failed to parse mac-prefix '%s'", m.MACPrefix))
+		}
+		m.MACPrefix = formatHexBytes(prefix)
+	}
+	for i := range m.Options {
+		if err := m.Options[i].Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// Matches returns true if a client with given hardware address, that sent a request
+// with given options and relay agent information, satisfies all conditions of this match.
+func (m ClassMatch) Matches(chAddr net.HardwareAddr, options dhcp.Options, info *RelayAgentInfo) bool {
+	if m.VendorClass != "" {
+		vendorClass, ok := options[dhcp.OptionVendorClassIdentifier]
+		if !ok || !matchPattern(m.VendorClass, string(vendorClass)) {
+			return false
+		}
+	}
+	if m.UserClass != "" {
+		found := false
+		for _, userClass := range userClasses(options) {
+			if matchPattern(m.UserClass, userClass) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if m.MACPrefix != "" && !strings.HasPrefix(chAddr.String(), m.MACPrefix) {
+		return false
+	}
+	if !m.RelayAgent.Matches(info) {
+		return false
+	}
+	for _, o := range m.Options {
+		if !o.Matches(options) {
+			return false
+		}
+	}
+	return true
+}
+
+// OptionMatch is a condition on the value of an arbitrary option.
+// Without value, the option only has to be present.
+type OptionMatch struct {
+	Code   int    `json:"code"`             // Option code
+	Value  string `json:"value,omitempty"`  // Expected bytes as colon separated hex bytes
+	Offset int    `json:"offset,omitempty"` // Offset of the expected bytes in the option value
+}
+
+// Validate changes the values in the given match.
+// Returns nil if all ok, otherwise an error.
+func (m *OptionMatch) Validate() error {
+	if m.Code < 1 || m.Code > 254 {
+		return maskAny(fmt.Errorf("Option code out of range, got %d", m.Code))
+	}
+	if m.Offset < 0 || m.Offset >= maxOptionLength {
+		return maskAny(fmt.Errorf("Offset of option %d out of range, got %d", m.Code, m.Offset))
+	}
+	if m.Value != "" {
+		value, err := parseHexBytes(m.Value)
+		if err != nil {
+			return maskAny(fmt.Errorf("Failed to parse value '%s' of option %d", m.Value, m.Code))
+		}
+		m.Value = formatHexBytes(value)
+	}
+	return nil
+}
+
+// Matches returns true if the given options contain the option of this match,
+// with the expected bytes at the expected offset.
+func (m OptionMatch) Matches(options dhcp.Options) bool {
+	data, ok := options[dhcp.OptionCode(m.Code)]
+	if !ok {
+		return false
+	}
+	if m.Value == "" {
+		return true
+	}
+	value, err := parseHexBytes(m.Value)
+	if err != nil || len(data) < m.Offset+len(value) {
+		return false
+	}
+	return bytes.Equal(data[m.Offset:m.Offset+len(value)], value)
+}
+
+// matchPattern returns true if the given value equals the given pattern.
+// A trailing '*' in the pattern matches any suffix.
+func matchPattern(pattern, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return value == pattern
+}
+
+// hasClass returns true if the given list of class names contains one of the given names.
+func hasClass(classes []string, names ...string) bool {
+	for _, c := range classes {
+		for _, n := range names {
+			if c == n {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestClassRejectsNetworkOptions(t *testing.T) {
+	match := ClassMatch{VendorClass: "PXEClient*"}
+	tests := []DHCPOptions{
+		{RouterIP: "10.0.0.1"},
+		{Routers: []string{"10.0.0.1"}},
+		{SubnetMask: "255.255.255.0"},
+		{Routes: []Route{{Destination: "10.244.0.0/16", Gateway: "10.0.0.5"}}},
+		{Custom: []CustomOption{{Name: "classless-static-routes", Value: []byte(`[{"destination": "10.244.0.0/16", "gateway": "10.0.0.5"}]`)}}},
+		{Custom: []CustomOption{{Code: 3, Type: "ip", Value: []byte(`"10.0.0.1"`)}}},
+	}
+	for _, options := range tests {
+		c := ClientClass{Name: "pxe", Match: match, Options: options}
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected class with options %+v to be invalid", options)
+		}
+	}
+	c := ClientClass{Name: "pxe", Match: match, Options: DHCPOptions{NTPServers: []string{"10.0.0.123"}}}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Expected class with network independent options to be valid, got %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
+	"time"
 
 	dhcp "github.com/krolaw/dhcp4"
 )
@@ -10,67 +12,283 @@ import (
 // DHCPConfig holds the configuration structure of the DHCP server.
 type DHCPConfig struct {
 	// ServerIP is the IP address of the server itself
-	ServerIP string         `json:"server-ip"`
-	Ranges   []AddressRange `json:"ranges"`
-	Options  DHCPOptions    `json:"options"`
+	ServerIP string `json:"server-ip"`
+	// The subnet the server is connected to.
+	// If its subnet is not set, it is derived from the server IP and the subnet-mask option.
+	// Its options are also the global options.
+	SubnetConfig
+	// Subnets holds additional subnets, reached through DHCP relay agents.
+	Subnets      []SubnetConfig `json:"subnets,omitempty"`
+	Reservations []Reservation  `json:"reservations,omitempty"`
+	// Classes holds groups of clients that get specific ranges and/or options.
+	Classes []ClientClass `json:"classes,omitempty"`
+	// Authoritative makes the server answer requests of clients it has no record of,
+	// and NAK requests for addresses on other networks.
+	// Only set this when this is the only DHCP server for its subnets.
+	Authoritative bool `json:"authoritative,omitempty"`
+	// ClientMatch is the strategy used to decide to which client a lease belongs.
+	// One of "client-id" (default), "mac" or "both".
+	ClientMatch ClientMatch `json:"client-match,omitempty"`
+	// OfferTimeout is the time an offered address is held for the client (e.g. "1m").
+	OfferTimeout string `json:"offer-timeout,omitempty"`
+	// DeclineQuarantine is the time an address declined by a client is not used (e.g. "1h").
+	DeclineQuarantine string `json:"decline-quarantine,omitempty"`
+	// PingCheck enables probing an address with an ICMP echo request before offering it.
+	// Probes are sent while serving a discover, which delays all other requests,
+	// up to 3 times the ping timeout.
+	// Addresses that respond are quarantined.
+	PingCheck bool `json:"ping-check,omitempty"`
+	// PingTimeout is the time to wait for a response to a probe (e.g. "500ms"), at most 1s.
+	PingTimeout string `json:"ping-timeout,omitempty"`
+	// DNSUpdate configures the registration of leased hosts in DNS.
+	DNSUpdate *DNSUpdateConfig `json:"dns-update,omitempty"`
+	// Access restricts the clients that are served, by hardware address.
+	Access *AccessConfig `json:"access,omitempty"`
 }
 
+const (
+	// defaultSubnetMask is the subnet mask used when none is configured.
+	defaultSubnetMask = "255.255.255.0"
+	// defaultOfferTimeout is the offer timeout used when none is configured.
+	defaultOfferTimeout = time.Minute
+	// defaultDeclineQuarantine is the decline quarantine used when none is configured.
+	defaultDeclineQuarantine = time.Hour
+	// defaultPingTimeout is the ping timeout used when none is configured.
+	defaultPingTimeout = 500 * time.Millisecond
+	// maxPingTimeout is the maximum ping timeout, since probes delay all requests.
+	maxPingTimeout = time.Second
+)
+
 // DHCPOptions holds various options of the DHCP protocol
 type DHCPOptions struct {
-	SubnetMask  string `json:"subnet-mask,omitempty"`
-	RouterIP    string `json:"router-ip,omitempty"`
-	DNSServerIP string `json:"dns-ip,omitempty"`
-	DomainName  string `json:"domain,omitempty"`
+	SubnetMask  string   `json:"subnet-mask,omitempty"`
+	RouterIP    string   `json:"router-ip,omitempty"` // Single router, added in front of Routers
+	Routers     []string `json:"routers,omitempty"`
+	DNSServerIP string   `json:"dns-ip,omitempty"` // Single DNS server, added in front of DNSServers
+	DNSServers  []string `json:"dns-servers,omitempty"`
+	NTPServers  []string `json:"ntp-servers,omitempty"`
+	DomainName  string   `json:"domain,omitempty"`
+	// DomainSearch holds the domain search list of the resolver (option 119).
+	DomainSearch []string `json:"domain-search,omitempty"`
+	// Routes holds classless static routes (option 121 & 249).
+	// When routers are given, a default route via the first router is added.
+	Routes []Route `json:"routes,omitempty"`
+	// Custom holds options with a typed value, overriding the options above.
+	Custom []CustomOption `json:"custom,omitempty"`
 }
 
 // Validate changes the values in the given config.
 // Returns nil if all ok, otherwise an error.
-func (o DHCPOptions) Validate() error {
+func (o *DHCPOptions) Validate() error {
 	if o.SubnetMask != "" {
 		if ip := parseIP(o.SubnetMask); ip == nil {
 			return maskAny(fmt.Errorf("Failed to parse subnet-mask option '%s'", o.SubnetMask))
 		}
 	}
 	if o.RouterIP != "" {
-		if ip := parseIP(o.RouterIP); ip == nil {
-			return maskAny(fmt.Errorf("Failed to parse router-ip option '%s'", o.RouterIP))
-		}
+		o.Routers = append([]string{o.RouterIP}, o.Routers...)
+		o.RouterIP = ""
 	}
 	if o.DNSServerIP != "" {
-		if ip := parseIP(o.DNSServerIP); ip == nil {
-			return maskAny(fmt.Errorf("Failed to parse dns-ip option '%s'", o.DNSServerIP))
+		o.DNSServers = append([]string{o.DNSServerIP}, o.DNSServers...)
+		o.DNSServerIP = ""
+	}
+	for _, list := range []struct {
+		name   string
+		values []string
+	}{
+		{"routers", o.Routers},
+		{"dns-servers", o.DNSServers},
+		{"ntp-servers", o.NTPServers},
+	} {
+		for _, v := range list.values {
+			if ip := parseIP(v); ip == nil || ip.To4() == nil {
+				return maskAny(fmt.Errorf("Failed to parse %s option '%s'", list.name, v))
+			}
+		}
+	}
+	if len(o.Routes) > 0 {
+		if _, err := encodeRoutes(o.routesWithDefault()); err != nil {
+			return maskAny(err)
+		}
+	}
+	for i, name := range o.DomainSearch {
+		if err := validateDomainName(name); err != nil {
+			return maskAny(err)
+		}
+		o.DomainSearch[i] = canonicalDomainName(name)
+	}
+	codes := make(map[int]struct{})
+	for i := range o.Custom {
+		c := &o.Custom[i]
+		if err := c.Validate(); err != nil {
+			return maskAny(err)
+		}
+		if _, found := codes[c.Code]; found {
+			return maskAny(fmt.Errorf("Duplicate option %d", c.Code))
+		}
+		codes[c.Code] = struct{}{}
+	}
+	return nil
+}
+
+// ValidateInSubnet checks that all routers and route gateways of the options
+// are directly reachable in the given subnet.
+func (o DHCPOptions) ValidateInSubnet(subnet *net.IPNet) error {
+	for _, r := range o.Routers {
+		if !subnet.Contains(parseIP(r)) {
+			return maskAny(fmt.Errorf("Router '%s' is not in subnet %s", r, subnet))
+		}
+	}
+	for _, r := range o.Routes {
+		// A gateway of 0.0.0.0 means that the destination is on the link itself (RFC 3442)
+		if gw := parseIP(r.Gateway); !gw.Equal(net.IPv4zero) && !subnet.Contains(gw) {
+			return maskAny(fmt.Errorf("Gateway '%s' of route to %s is not in subnet %s", r.Gateway, r.Destination, subnet))
 		}
 	}
 	return nil
 }
 
-// AddressRange is a range of IP addresses that can be assigned.
+// routesWithDefault returns the classless static routes, with a default route
+// via the first router added when there are routers and no default route is given.
+// Clients that support classless static routes ignore the router option (RFC 3442).
+func (o DHCPOptions) routesWithDefault() []Route {
+	if len(o.Routers) == 0 {
+		return o.Routes
+	}
+	for _, r := range o.Routes {
+		if _, destination, err := net.ParseCIDR(r.Destination); err == nil {
+			if ones, _ := destination.Mask.Size(); ones == 0 {
+				return o.Routes
+			}
+		}
+	}
+	return append(append([]Route{}, o.Routes...), Route{Destination: "0.0.0.0/0", Gateway: o.Routers[0]})
+}
+
+// Merge returns a copy of the options, with all fields that are set
+// in the given override replaced.
+func (o DHCPOptions) Merge(override DHCPOptions) DHCPOptions {
+	if override.SubnetMask != "" {
+		o.SubnetMask = override.SubnetMask
+	}
+	if len(override.Routers) > 0 {
+		o.Routers = override.Routers
+	}
+	if len(override.DNSServers) > 0 {
+		o.DNSServers = override.DNSServers
+	}
+	if len(override.NTPServers) > 0 {
+		o.NTPServers = override.NTPServers
+	}
+	if len(override.Routes) > 0 {
+		o.Routes = override.Routes
+	}
+	if len(override.DomainSearch) > 0 {
+		o.DomainSearch = override.DomainSearch
+	}
+	if override.DomainName != "" {
+		o.DomainName = override.DomainName
+	}
+	o.Custom = mergeCustomOptions(o.Custom, override.Custom)
+	return o
+}
+
+// Inherit returns a copy of the given options, with all network independent
+// fields that are not set taken from these options.
+// Custom options are inherited unless the given options override them.
+func (o DHCPOptions) Inherit(options DHCPOptions) DHCPOptions {
+	if len(options.DNSServers) == 0 {
+		options.DNSServers = o.DNSServers
+	}
+	if len(options.NTPServers) == 0 {
+		options.NTPServers = o.NTPServers
+	}
+	if len(options.DomainSearch) == 0 {
+		options.DomainSearch = o.DomainSearch
+	}
+	if options.DomainName == "" {
+		options.DomainName = o.DomainName
+	}
+	options.Custom = mergeCustomOptions(o.Custom, options.Custom)
+	return options
+}
+
+// AddressRange is a range of IP addresses.
+// The range is specified by its first address and either its last address or its length.
 type AddressRange struct {
-	Start  string `json:"start"`  // First IP address
-	Length int    `json:"length"` // Number of addresses in this range
+	Start  string `json:"start"`            // First IP address
+	End    string `json:"end,omitempty"`    // Last IP address (inclusive)
+	Length int    `json:"length,omitempty"` // Number of addresses in this range
+	// RelayAgent restricts the use of this range to clients with matching relay agent information.
+	RelayAgent RelayAgentMatch `json:"relay-agent,omitempty"`
+	// Classes restricts the use of this range to clients that are a member of one of these classes.
+	Classes []string `json:"classes,omitempty"`
+	// Options of this range, overriding the options of the subnet.
+	Options DHCPOptions `json:"options,omitempty"`
+	// Lease times of this range, overriding the lease times of the subnet.
+	LeaseTimes
 }
 
 // Validate changes the values in the given range.
 // Returns nil if all ok, otherwise an error.
-func (r AddressRange) Validate() error {
-	ip := parseIP(r.Start)
-	if ip == nil {
+func (r *AddressRange) Validate() error {
+	start := parseIP(r.Start)
+	if start == nil || start.To4() == nil {
 		return maskAny(fmt.Errorf("Failed to parse range start '%s'", r.Start))
 	}
+	if r.End != "" {
+		end := parseIP(r.End)
+		if end == nil || end.To4() == nil {
+			return maskAny(fmt.Errorf("Failed to parse range end '%s'", r.End))
+		}
+		if dhcp.IPLess(end, start) {
+			return maskAny(fmt.Errorf("Range end '%s' is before range start '%s'", r.End, r.Start))
+		}
+		length := dhcp.IPRange(start, end)
+		if r.Length != 0 && r.Length != length {
+			return maskAny(fmt.Errorf("Range length %d does not match range '%s'-'%s'", r.Length, r.Start, r.End))
+		}
+		r.Length = length
+	}
 	if r.Length < 1 {
 		return maskAny(fmt.Errorf("Range length must be >= 1, got %d", r.Length))
 	}
-	if int(ip[len(ip)-1])+r.Length > 255 {
+	if uint64(binary.BigEndian.Uint32(start))+uint64(r.Length) > 1<<32 {
 		return maskAny(fmt.Errorf("Range length out of range, got %d", r.Length))
 	}
+	r.End = r.Last().String()
+	if err := r.Options.Validate(); err != nil {
+		return maskAny(err)
+	}
+	if err := r.LeaseTimes.Validate(); err != nil {
+		return maskAny(err)
+	}
 	return nil
 }
 
+// First returns the first IP address of this range.
+func (r AddressRange) First() net.IP {
+	return parseIP(r.Start)
+}
+
+// Last returns the last IP address of this range.
+func (r AddressRange) Last() net.IP {
+	return dhcp.IPAdd(r.First(), r.Length-1)
+}
+
 // Contains returns true when the given IP is part of this range, false otherwise.
 func (r AddressRange) Contains(ip net.IP) bool {
-	start := parseIP(r.Start)
-	stop := dhcp.IPAdd(start, r.Length)
-	return dhcp.IPInRange(start, stop, ip)
+	return dhcp.IPInRange(r.First(), r.Last(), ip)
+}
+
+// AllowsClient returns true when this range can be used by a client with given
+// relay agent information that is a member of the given classes.
+func (r AddressRange) AllowsClient(info *RelayAgentInfo, classes []string) bool {
+	if len(r.Classes) > 0 && !hasClass(classes, r.Classes...) {
+		return false
+	}
+	return r.RelayAgent.Matches(info)
 }
 
 // Validate changes the values in the given config.
@@ -79,16 +297,200 @@ func (c *DHCPConfig) Validate(defaultServerIP string) error {
 	if c.ServerIP == "" {
 		c.ServerIP = defaultServerIP
 	}
-	if ip := parseIP(c.ServerIP); ip == nil {
+	serverIP := parseIP(c.ServerIP)
+	if serverIP == nil || serverIP.To4() == nil {
 		return maskAny(fmt.Errorf("Failed to parse server-ip '%s'", c.ServerIP))
 	}
-	for _, r := range c.Ranges {
+	if c.Subnet == "" {
+		subnetMask := c.Options.SubnetMask
+		if subnetMask == "" {
+			subnetMask = defaultSubnetMask
+		}
+		mask := net.IPMask(parseIP(subnetMask).To4())
+		if mask == nil {
+			return maskAny(fmt.Errorf("Invalid subnet-mask option '%s'", subnetMask))
+		}
+		c.Subnet = (&net.IPNet{IP: serverIP.Mask(mask), Mask: mask}).String()
+	}
+	if err := c.SubnetConfig.Validate(); err != nil {
+		return maskAny(err)
+	}
+	if c.ClientMatch == "" {
+		c.ClientMatch = ClientMatchClientID
+	} else if !c.ClientMatch.IsValid() {
+		return maskAny(fmt.Errorf("Invalid client-match '%s'", c.ClientMatch))
+	}
+	if c.OfferTimeout != "" {
+		if d, err := time.ParseDuration(c.OfferTimeout); err != nil || d <= 0 {
+			return maskAny(fmt.Errorf("Failed to parse offer-timeout '%s'", c.OfferTimeout))
+		}
+	}
+	if c.DeclineQuarantine != "" {
+		if d, err := time.ParseDuration(c.DeclineQuarantine); err != nil || d < 0 {
+			return maskAny(fmt.Errorf("Failed to parse decline-quarantine '%s'", c.DeclineQuarantine))
+		}
+	}
+	if c.PingTimeout != "" {
+		if d, err := time.ParseDuration(c.PingTimeout); err != nil || d <= 0 {
+			return maskAny(fmt.Errorf("Failed to parse ping-timeout '%s'", c.PingTimeout))
+		} else if d > maxPingTimeout {
+			return maskAny(fmt.Errorf("Ping-timeout '%s' is longer than %s", c.PingTimeout, maxPingTimeout))
+		}
+	}
+	if c.DNSUpdate != nil {
+		if err := c.DNSUpdate.Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	if c.Access != nil {
+		if err := c.Access.Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	if subnet := c.GetSubnet(); !subnet.Contains(serverIP) {
+		return maskAny(fmt.Errorf("Server-ip '%s' is not in subnet %s", c.ServerIP, subnet))
+	}
+	for i := range c.Subnets {
+		s := &c.Subnets[i]
+		if err := s.Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	subnets := c.AllSubnets()
+	for i, s := range subnets {
+		for _, other := range subnets[i+1:] {
+			if s.GetSubnet().Contains(other.GetSubnet().IP) || other.GetSubnet().Contains(s.GetSubnet().IP) {
+				return maskAny(fmt.Errorf("Subnet %s overlaps with subnet %s", s.Subnet, other.Subnet))
+			}
+		}
+	}
+	for _, s := range subnets {
+		// Lease times of every scope must be consistent with the lease times they inherit
+		if err := s.LeaseTimes.ValidateEffective(); err != nil {
+			return maskAny(fmt.Errorf("Subnet %s: %v", s.Subnet, err))
+		}
+		for _, r := range s.Ranges {
+			if err := s.LeaseTimes.Merge(r.LeaseTimes).ValidateEffective(); err != nil {
+				return maskAny(fmt.Errorf("Range '%s'-'%s': %v", r.Start, r.End, err))
+			}
+		}
+	}
+	classes := make(map[string]struct{})
+	for i := range c.Classes {
+		cc := &c.Classes[i]
+		if err := cc.Validate(); err != nil {
+			return maskAny(err)
+		}
+		if _, found := classes[cc.Name]; found {
+			return maskAny(fmt.Errorf("Duplicate class '%s'", cc.Name))
+		}
+		classes[cc.Name] = struct{}{}
+	}
+	for _, s := range subnets {
+		for _, r := range s.Ranges {
+			for _, name := range r.Classes {
+				if _, found := classes[name]; !found {
+					return maskAny(fmt.Errorf("Range '%s'-'%s' uses unknown class '%s'", r.Start, r.End, name))
+				}
+			}
+		}
+	}
+	chAddrs := make(map[string]struct{})
+	clientIDs := make(map[string]struct{})
+	ips := make(map[string]struct{})
+	for i := range c.Reservations {
+		r := &c.Reservations[i]
 		if err := r.Validate(); err != nil {
 			return maskAny(err)
 		}
+		s := c.FindSubnet(parseIP(r.IP))
+		if s == nil {
+			return maskAny(fmt.Errorf("Reservation ip '%s' is not in any subnet", r.IP))
+		}
+		if parseIP(r.IP).Equal(serverIP) {
+			return maskAny(fmt.Errorf("Reservation ip '%s' is the server-ip", r.IP))
+		}
+		if s.IsExcluded(parseIP(r.IP)) {
+			return maskAny(fmt.Errorf("Reservation ip '%s' is excluded in subnet %s", r.IP, s.Subnet))
+		}
+		if err := r.Options.ValidateInSubnet(s.GetSubnet()); err != nil {
+			return maskAny(err)
+		}
+		if _, found := ips[r.IP]; found {
+			return maskAny(fmt.Errorf("Duplicate reservation for ip '%s'", r.IP))
+		}
+		ips[r.IP] = struct{}{}
+		// A client can have a reservation in every subnet
+		if r.CHAddr != "" {
+			key := s.Subnet + "/" + r.CHAddr
+			if _, found := chAddrs[key]; found {
+				return maskAny(fmt.Errorf("Duplicate reservation for chaddr '%s' in subnet %s", r.CHAddr, s.Subnet))
+			}
+			chAddrs[key] = struct{}{}
+		}
+		if r.ClientID != "" {
+			key := s.Subnet + "/" + r.ClientID
+			if _, found := clientIDs[key]; found {
+				return maskAny(fmt.Errorf("Duplicate reservation for client-id '%s' in subnet %s", r.ClientID, s.Subnet))
+			}
+			clientIDs[key] = struct{}{}
+		}
 	}
-	if err := c.Options.Validate(); err != nil {
-		return maskAny(err)
+	return nil
+}
+
+// GetOfferTimeout returns the time an offered address is held for the client.
+func (c DHCPConfig) GetOfferTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.OfferTimeout); err == nil {
+		return d
+	}
+	return defaultOfferTimeout
+}
+
+// GetDeclineQuarantine returns the time an address declined by a client is not used.
+func (c DHCPConfig) GetDeclineQuarantine() time.Duration {
+	if d, err := time.ParseDuration(c.DeclineQuarantine); err == nil {
+		return d
+	}
+	return defaultDeclineQuarantine
+}
+
+// GetPingTimeout returns the time to wait for a response to a probe.
+func (c DHCPConfig) GetPingTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.PingTimeout); err == nil {
+		return d
+	}
+	return defaultPingTimeout
+}
+
+// AllSubnets returns the subnet the server is connected to, followed
+// by all additional subnets.
+// Network independent options, lease times, the hostname template and the boot
+// configuration of the subnet the server is connected to are inherited by the
+// additional subnets.
+func (c DHCPConfig) AllSubnets() []SubnetConfig {
+	result := []SubnetConfig{c.SubnetConfig}
+	for _, s := range c.Subnets {
+		s.Options = c.Options.Inherit(s.Options)
+		s.LeaseTimes = c.LeaseTimes.Merge(s.LeaseTimes)
+		if s.HostnameTemplate == "" {
+			s.HostnameTemplate = c.HostnameTemplate
+		}
+		if s.Boot == nil {
+			s.Boot = c.Boot
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// FindSubnet returns the subnet that contains the given IP, or nil if
+// there is no such subnet.
+func (c DHCPConfig) FindSubnet(ip net.IP) *SubnetConfig {
+	for _, s := range c.AllSubnets() {
+		if s.GetSubnet().Contains(ip) {
+			return &s
+		}
 	}
 	return nil
 }
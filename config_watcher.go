@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 
 	"github.com/ericchiang/k8s"
@@ -13,20 +12,21 @@ import (
 // watchForConfigChanges starts a process that continues to watch for configuration
 // changes until the given context is canceled.
 func watchForConfigChanges(ctx context.Context, cli *k8s.Client, configMapName, namespace, nodeIP string, configChan chan DHCPConfig) {
-	// Load config, then watch for changes
+	// Load config, then watch for changes.
+	// Only the config ConfigMap is watched, the namespace also holds frequently
+	// updated ConfigMaps such as the lease registry and the leader election lock.
 	var configMap corev1.ConfigMap
-	watcher, err := cli.Watch(ctx, namespace, &configMap)
+	watcher, err := cli.Watch(ctx, namespace, &configMap, k8s.QueryParam("fieldSelector", "metadata.name="+configMapName))
 	if err != nil {
 		log.Fatalf("Failed to create ConfigMap watcher")
 	}
 	defer watcher.Close()
 	for {
 		cm := new(corev1.ConfigMap)
-		eventType, err := watcher.Next(cm)
+		_, err := watcher.Next(cm)
 		if err != nil {
 			log.Fatalf("Failed to watch next event: %v", err)
 		}
-		fmt.Println(eventType, *cm.Metadata.Name)
 		if cm.Metadata.GetName() != configMapName {
 			continue
 		}
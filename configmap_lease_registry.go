@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+const (
+	// configMapLeaseCacheTTL is the maximum age of the cached ConfigMap used for read operations.
+	configMapLeaseCacheTTL = 5 * time.Second
+	// configMapLeaseUpdateAttempts is the number of times an update is tried in case of conflicts.
+	configMapLeaseUpdateAttempts = 5
+	// configMapMaxDataSize is the maximum size of the leases stored in the ConfigMap.
+	// Kubernetes limits the size of a ConfigMap to 1MiB, some room is left for its metadata.
+	configMapMaxDataSize = 1000 * 1024
+)
+
+type configMapLeaseRegistry struct {
+	mutex     sync.Mutex
+	client    *k8s.Client
+	name      string
+	namespace string
+	configMap *corev1.ConfigMap // Last known version of the ConfigMap
+	loadedAt  time.Time         // Time configMap was last loaded
+}
+
+// NewConfigMapLeaseRegistry creates an implementation of the LeaseRegistry that
+// stores all leases in a ConfigMap with given name in the given namespace.
+// Each lease is stored as a JSON encoded data item, keyed by its IP address.
+// Read operations are served from a cached ConfigMap that can be a few seconds old.
+// Write operations check the current lease of the IP, so a lease held by another
+// client is never replaced.
+// Since the size of a ConfigMap is limited to 1MiB, this registry can hold a few thousand leases.
+func NewConfigMapLeaseRegistry(client *k8s.Client, name, namespace string) LeaseRegistry {
+	return &configMapLeaseRegistry{
+		client:    client,
+		name:      name,
+		namespace: namespace,
+	}
+}
+
+// Get the lease for the given IP
+func (r *configMapLeaseRegistry) GetByIP(ip string) (*Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cm, err := r.load(context.Background(), false)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	data, found := cm.GetData()[ip]
+	if !found {
+		return nil, maskAny(LeaseNotFoundError)
+	}
+	var l Lease
+	if err := json.Unmarshal([]byte(data), &l); err != nil {
+		return nil, maskAny(err)
+	}
+	return &l, nil
+}
+
+// Get all leases
+func (r *configMapLeaseRegistry) List() ([]Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	cm, err := r.load(context.Background(), false)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for key, data := range cm.GetData() {
+		var l Lease
+		if err := json.Unmarshal([]byte(data), &l); err != nil {
+			log.Printf("Failed to parse lease '%s': %v\n", key, err)
+			continue
+		}
+		result = append(result, l)
+	}
+	return result, nil
+}
+
+// Get all the leases for the given hardware address
+func (r *configMapLeaseRegistry) ListByCHAddr(chAddr string) ([]Lease, error) {
+	all, err := r.List()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, l := range all {
+		if l.CHAddr == chAddr {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// Get all the leases for the given client identifier
+func (r *configMapLeaseRegistry) ListByClientID(clientID string) ([]Lease, error) {
+	all, err := r.List()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, l := range all {
+		if l.ClientID == clientID {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// Get all the leases for the given fully qualified domain name
+func (r *configMapLeaseRegistry) ListByFQDN(fqdn string) ([]Lease, error) {
+	all, err := r.List()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, l := range all {
+		if strings.EqualFold(l.FQDN, fqdn) {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// Remove the given lease
+func (r *configMapLeaseRegistry) Remove(l *Lease) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.update(context.Background(), func(data map[string]string) error {
+		if current, found := parseLeaseData(data, l.IP); found && !canReplace(current, *l) {
+			return maskAny(LeaseConflictError)
+		}
+		delete(data, l.IP)
+		return nil
+	}); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// Create stores the given lease, expiring after the given time to live.
+func (r *configMapLeaseRegistry) Create(l Lease, ttl time.Duration) (*Lease, error) {
+	l.ExpiratesAt = newTime(time.Now().Add(ttl))
+	encoded, err := json.Marshal(l)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.update(context.Background(), func(data map[string]string) error {
+		if current, found := parseLeaseData(data, l.IP); found && !canReplace(current, l) {
+			return maskAny(LeaseConflictError)
+		}
+		data[l.IP] = string(encoded)
+		return nil
+	}); err != nil {
+		return nil, maskAny(err)
+	}
+	return &l, nil
+}
+
+// Reload discards the cached ConfigMap and loads its current version.
+func (r *configMapLeaseRegistry) Reload() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.load(context.Background(), true); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// load returns the ConfigMap containing the leases.
+// When force is false, a cached version is returned if it is recent enough.
+// If the ConfigMap does not exist, it is created.
+// The mutex must be held when calling this function.
+func (r *configMapLeaseRegistry) load(ctx context.Context, force bool) (*corev1.ConfigMap, error) {
+	if !force && r.configMap != nil && time.Since(r.loadedAt) < configMapLeaseCacheTTL {
+		return r.configMap, nil
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.client.Get(ctx, r.namespace, r.name, cm); isNotFound(err) {
+		// ConfigMap does not exist yet, create it
+		cm = &corev1.ConfigMap{
+			Metadata: &metav1.ObjectMeta{
+				Name:      k8s.String(r.name),
+				Namespace: k8s.String(r.namespace),
+			},
+			Data: make(map[string]string),
+		}
+		if err := r.client.Create(ctx, cm); isConflict(err) {
+			// Someone else created it in the meantime
+			cm = &corev1.ConfigMap{}
+			if err := r.client.Get(ctx, r.namespace, r.name, cm); err != nil {
+				return nil, maskAny(err)
+			}
+		} else if err != nil {
+			return nil, maskAny(err)
+		}
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	r.configMap = cm
+	r.loadedAt = time.Now()
+	return cm, nil
+}
+
+// update applies the given modification to the data of the ConfigMap and
+// stores the result.
+// The update is made against the resource version of the loaded ConfigMap,
+// so concurrent modifications are detected. In that case the ConfigMap is
+// reloaded and the modification is tried again.
+// The mutex must be held when calling this function.
+func (r *configMapLeaseRegistry) update(ctx context.Context, modify func(data map[string]string) error) error {
+	for attempt := 0; attempt < configMapLeaseUpdateAttempts; attempt++ {
+		cm, err := r.load(ctx, attempt > 0)
+		if err != nil {
+			return maskAny(err)
+		}
+		data := make(map[string]string)
+		for k, v := range cm.GetData() {
+			data[k] = v
+		}
+		if err := modify(data); err != nil {
+			return maskAny(err)
+		}
+		purgeLeaseData(data)
+		size := 0
+		for k, v := range data {
+			size += len(k) + len(v)
+		}
+		if size > configMapMaxDataSize {
+			return maskAny(fmt.Errorf("ConfigMap '%s' is full, use the crd lease registry", r.name))
+		}
+		meta := *cm.GetMetadata()
+		updated := &corev1.ConfigMap{
+			Metadata: &meta,
+			Data:     data,
+		}
+		if err := r.client.Update(ctx, updated); isConflict(err) {
+			// ConfigMap has been modified by someone else, try again
+			continue
+		} else if err != nil {
+			return maskAny(err)
+		}
+		r.configMap = updated
+		r.loadedAt = time.Now()
+		return nil
+	}
+	return maskAny(fmt.Errorf("Failed to update ConfigMap '%s' after %d attempts", r.name, configMapLeaseUpdateAttempts))
+}
+
+// parseLeaseData returns the lease for the given IP found in the given data.
+// Returns false if there is no (valid) lease for the IP.
+func parseLeaseData(data map[string]string, ip string) (Lease, bool) {
+	var l Lease
+	value, found := data[ip]
+	if !found || json.Unmarshal([]byte(value), &l) != nil {
+		return l, false
+	}
+	return l, true
+}
+
+// purgeLeaseData removes all expired offered and quarantined leases from the given data.
+// Expired bound leases are kept, so clients can get their previous address back.
+func purgeLeaseData(data map[string]string) {
+	for ip := range data {
+		if l, found := parseLeaseData(data, ip); found && l.IsExpired() && l.GetState() != LeaseStateBound {
+			delete(data, ip)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+)
+
+const (
+	// coreDNSHostsUpdateAttempts is the number of times an update is tried in case of conflicts.
+	coreDNSHostsUpdateAttempts = 5
+	// coreDNSHostsHeader is the first line of a hosts file maintained by the server.
+	coreDNSHostsHeader = "# Maintained by kube-dhcp, do not edit"
+)
+
+type coreDNSHostsUpdater struct {
+	mutex     sync.Mutex
+	client    *k8s.Client
+	name      string
+	namespace string
+	key       string
+}
+
+// NewCoreDNSHostsUpdater creates a DNSUpdater that maintains a hosts file in the data
+// item with given key of the ConfigMap with given name in the given namespace.
+// The ConfigMap is intended to be mounted in CoreDNS and served using its hosts plugin,
+// which serves both the forward and the reverse (PTR) records of every entry.
+func NewCoreDNSHostsUpdater(client *k8s.Client, name, namespace, key string) DNSUpdater {
+	return &coreDNSHostsUpdater{
+		client:    client,
+		name:      name,
+		namespace: namespace,
+		key:       key,
+	}
+}
+
+// Add (or replace) the forward and reverse records of the given lease.
+func (u *coreDNSHostsUpdater) Update(l Lease) error {
+	fqdn := canonicalDomainName(l.FQDN)
+	return u.update(func(hosts map[string]string) {
+		// A name can only point to a single address
+		for ip, name := range hosts {
+			if name == fqdn {
+				delete(hosts, ip)
+			}
+		}
+		hosts[l.IP] = fqdn
+	})
+}
+
+// Remove the forward and reverse records of the given lease.
+func (u *coreDNSHostsUpdater) Remove(l Lease) error {
+	fqdn := canonicalDomainName(l.FQDN)
+	return u.update(func(hosts map[string]string) {
+		if hosts[l.IP] == fqdn {
+			delete(hosts, l.IP)
+		}
+	})
+}
+
+// update applies the given modification to the hosts file and stores the result.
+// The update is made against the resource version of the loaded ConfigMap,
+// so concurrent modifications are detected. In that case the modification is tried again.
+func (u *coreDNSHostsUpdater) update(modify func(hosts map[string]string)) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	ctx := context.Background()
+	for attempt := 0; attempt < coreDNSHostsUpdateAttempts; attempt++ {
+		cm := &corev1.ConfigMap{}
+		if err := u.client.Get(ctx, u.namespace, u.name, cm); err != nil {
+			return maskAny(err)
+		}
+		hosts := parseHostsFile(cm.GetData()[u.key])
+		modify(hosts)
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[u.key] = formatHostsFile(hosts)
+		if err := u.client.Update(ctx, cm); isConflict(err) {
+			// ConfigMap has been modified by someone else, try again
+			continue
+		} else if err != nil {
+			return maskAny(err)
+		}
+		return nil
+	}
+	return maskAny(fmt.Errorf("Failed to update ConfigMap '%s' after %d attempts", u.name, coreDNSHostsUpdateAttempts))
+}
+
+// parseHostsFile parses the given hosts file into a map of IP -> name.
+// Only the first name of every entry is used.
+func parseHostsFile(data string) map[string]string {
+	hosts := make(map[string]string)
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 {
+			hosts[fields[0]] = fields[1]
+		}
+	}
+	return hosts
+}
+
+// formatHostsFile formats the given map of IP -> name as a hosts file,
+// sorted by IP address.
+func formatHostsFile(hosts map[string]string) string {
+	ips := make([]string, 0, len(hosts))
+	for ip := range hosts {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		a, b := parseIP(ips[i]), parseIP(ips[j])
+		if a == nil || b == nil {
+			return ips[i] < ips[j]
+		}
+		return string(a.To16()) < string(b.To16())
+	})
+	lines := []string{coreDNSHostsHeader}
+	for _, ip := range ips {
+		lines = append(lines, ip+" "+hosts[ip])
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+const (
+	dhcpLeaseAPIGroup   = "dhcp.pulcy.com"
+	dhcpLeaseAPIVersion = "v1alpha1"
+	dhcpLeaseResource   = "dhcpleases"
+	dhcpLeaseKind       = "DHCPLease"
+	// dhcpLeaseCHAddrLabel is the label used to store the hardware address of a lease.
+	dhcpLeaseCHAddrLabel = dhcpLeaseAPIGroup + "/chaddr"
+	// dhcpLeaseClientIDLabel is the label used to store the client identifier of a lease.
+	dhcpLeaseClientIDLabel = dhcpLeaseAPIGroup + "/client-id"
+	// dhcpLeaseFQDNLabel is the label used to store the fully qualified domain name of a lease.
+	dhcpLeaseFQDNLabel = dhcpLeaseAPIGroup + "/fqdn"
+	// maxLabelValueLength is the maximum length of a label value.
+	maxLabelValueLength = 63
+)
+
+// DHCPLease is a custom resource holding a single lease.
+// The name of the resource is the leased IP address.
+type DHCPLease struct {
+	Kind       string             `json:"kind"`
+	APIVersion string             `json:"apiVersion"`
+	Metadata   *metav1.ObjectMeta `json:"metadata"`
+	Spec       Lease              `json:"spec"`
+}
+
+// GetMetadata returns the metadata of the resource.
+func (l *DHCPLease) GetMetadata() *metav1.ObjectMeta {
+	return l.Metadata
+}
+
+// DHCPLeaseList is a list of DHCPLease resources.
+type DHCPLeaseList struct {
+	Metadata *metav1.ListMeta `json:"metadata"`
+	Items    []DHCPLease      `json:"items"`
+}
+
+// GetMetadata returns the metadata of the list.
+func (l *DHCPLeaseList) GetMetadata() *metav1.ListMeta {
+	return l.Metadata
+}
+
+func init() {
+	k8s.Register(dhcpLeaseAPIGroup, dhcpLeaseAPIVersion, dhcpLeaseResource, true, &DHCPLease{})
+	k8s.RegisterList(dhcpLeaseAPIGroup, dhcpLeaseAPIVersion, dhcpLeaseResource, true, &DHCPLeaseList{})
+}
+
+type crdLeaseRegistry struct {
+	client    *k8s.Client
+	namespace string
+}
+
+// NewCRDLeaseRegistry creates an implementation of the LeaseRegistry that
+// stores every lease as a DHCPLease custom resource in the given namespace.
+func NewCRDLeaseRegistry(client *k8s.Client, namespace string) LeaseRegistry {
+	return &crdLeaseRegistry{
+		client:    client,
+		namespace: namespace,
+	}
+}
+
+// Get all leases
+func (r *crdLeaseRegistry) List() ([]Lease, error) {
+	var list DHCPLeaseList
+	if err := r.client.List(context.Background(), r.namespace, &list); err != nil {
+		return nil, maskAny(err)
+	}
+	result := make([]Lease, 0, len(list.Items))
+	for _, item := range list.Items {
+		result = append(result, item.Spec)
+	}
+	return result, nil
+}
+
+// Get the lease for the given IP
+func (r *crdLeaseRegistry) GetByIP(ip string) (*Lease, error) {
+	var res DHCPLease
+	if err := r.client.Get(context.Background(), r.namespace, ip, &res); isNotFound(err) {
+		return nil, maskAny(LeaseNotFoundError)
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	return &res.Spec, nil
+}
+
+// Get all the leases for the given hardware address
+func (r *crdLeaseRegistry) ListByCHAddr(chAddr string) ([]Lease, error) {
+	var list DHCPLeaseList
+	selector := k8s.QueryParam("labelSelector", dhcpLeaseCHAddrLabel+"="+chAddrLabelValue(chAddr))
+	if err := r.client.List(context.Background(), r.namespace, &list, selector); err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, item := range list.Items {
+		// Double check the address, in case the label value is ambiguous
+		if item.Spec.CHAddr == chAddr {
+			result = append(result, item.Spec)
+		}
+	}
+	return result, nil
+}
+
+// Get all the leases for the given client identifier
+func (r *crdLeaseRegistry) ListByClientID(clientID string) ([]Lease, error) {
+	var list DHCPLeaseList
+	selector := k8s.QueryParam("labelSelector", dhcpLeaseClientIDLabel+"="+clientIDLabelValue(clientID))
+	if err := r.client.List(context.Background(), r.namespace, &list, selector); err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, item := range list.Items {
+		// Double check the identifier, in case the label value is ambiguous
+		if item.Spec.ClientID == clientID {
+			result = append(result, item.Spec)
+		}
+	}
+	return result, nil
+}
+
+// Get all the leases for the given fully qualified domain name
+func (r *crdLeaseRegistry) ListByFQDN(fqdn string) ([]Lease, error) {
+	var list DHCPLeaseList
+	selector := k8s.QueryParam("labelSelector", dhcpLeaseFQDNLabel+"="+fqdnLabelValue(fqdn))
+	if err := r.client.List(context.Background(), r.namespace, &list, selector); err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, item := range list.Items {
+		// Double check the name, in case the label value is ambiguous
+		if strings.EqualFold(item.Spec.FQDN, fqdn) {
+			result = append(result, item.Spec)
+		}
+	}
+	return result, nil
+}
+
+// Remove the given lease, unless its resource now holds an unexpired lease of another client.
+func (r *crdLeaseRegistry) Remove(l *Lease) error {
+	var current DHCPLease
+	if err := r.client.Get(context.Background(), r.namespace, l.IP, &current); isNotFound(err) {
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	} else if !canReplace(current.Spec, *l) {
+		return maskAny(LeaseConflictError)
+	}
+	res := &DHCPLease{
+		Metadata: &metav1.ObjectMeta{
+			Name:      k8s.String(l.IP),
+			Namespace: k8s.String(r.namespace),
+		},
+	}
+	if err := r.client.Delete(context.Background(), res); err != nil && !isNotFound(err) {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// Create stores the given lease, expiring after the given time to live.
+// If a resource already exists for the IP of the lease, it is updated,
+// unless it holds an unexpired lease of another client.
+func (r *crdLeaseRegistry) Create(l Lease, ttl time.Duration) (*Lease, error) {
+	ctx := context.Background()
+	l.ExpiratesAt = newTime(time.Now().Add(ttl))
+	labels := map[string]string{
+		dhcpLeaseCHAddrLabel: chAddrLabelValue(l.CHAddr),
+	}
+	if l.ClientID != "" {
+		labels[dhcpLeaseClientIDLabel] = clientIDLabelValue(l.ClientID)
+	}
+	if l.FQDN != "" {
+		labels[dhcpLeaseFQDNLabel] = fqdnLabelValue(l.FQDN)
+	}
+	res := &DHCPLease{
+		Kind:       dhcpLeaseKind,
+		APIVersion: dhcpLeaseAPIGroup + "/" + dhcpLeaseAPIVersion,
+		Metadata: &metav1.ObjectMeta{
+			Name:      k8s.String(l.IP),
+			Namespace: k8s.String(r.namespace),
+			Labels:    labels,
+		},
+		Spec: l,
+	}
+	if err := r.client.Create(ctx, res); isConflict(err) {
+		// Resource already exists, update it using its current resource version
+		var current DHCPLease
+		if err := r.client.Get(ctx, r.namespace, l.IP, &current); err != nil {
+			return nil, maskAny(err)
+		}
+		if !canReplace(current.Spec, l) {
+			return nil, maskAny(LeaseConflictError)
+		}
+		res.Metadata.ResourceVersion = current.GetMetadata().ResourceVersion
+		if err := r.client.Update(ctx, res); err != nil {
+			return nil, maskAny(err)
+		}
+	} else if err != nil {
+		return nil, maskAny(err)
+	}
+	return &l, nil
+}
+
+// chAddrLabelValue converts the given hardware address into a valid label value.
+func chAddrLabelValue(chAddr string) string {
+	return strings.Replace(chAddr, ":", "-", -1)
+}
+
+// clientIDLabelValue converts the given client identifier into a valid label value.
+// Identifiers that are too long are replaced by a hash.
+func clientIDLabelValue(clientID string) string {
+	value := strings.Replace(clientID, ":", "", -1)
+	if len(value) > maxLabelValueLength {
+		hash := sha256.Sum256([]byte(clientID))
+		value = hex.EncodeToString(hash[:])[:maxLabelValueLength]
+	}
+	return value
+}
+
+// fqdnLabelValue converts the given fully qualified domain name into a valid label value.
+// Names that are too long are replaced by a hash.
+func fqdnLabelValue(fqdn string) string {
+	value := canonicalDomainName(fqdn)
+	if len(value) > maxLabelValueLength {
+		hash := sha256.Sum256([]byte(value))
+		value = hex.EncodeToString(hash[:])[:maxLabelValueLength]
+	}
+	return value
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ericchiang/k8s"
+)
+
+const (
+	// dnsUpdaterRFC2136 is the type of the DNS updater that sends dynamic updates (RFC 2136) to a DNS server.
+	dnsUpdaterRFC2136 = "rfc2136"
+	// dnsUpdaterCoreDNSHosts is the type of the DNS updater that maintains a hosts file
+	// for the CoreDNS hosts plugin in a ConfigMap.
+	dnsUpdaterCoreDNSHosts = "coredns-hosts"
+	// defaultDNSTTL is the TTL of DNS records used when none is configured.
+	defaultDNSTTL = 5 * time.Minute
+	// dnsCleanupInterval is the interval between checks for expired leases with DNS records.
+	dnsCleanupInterval = time.Minute
+	// maxDNSQueueLength is the maximum number of pending DNS updates.
+	maxDNSQueueLength = 1000
+)
+
+// DNSUpdateConfig holds the configuration of the DNS registration of leased hosts.
+// Hosts are only registered when they have a FQDN, so the domain option must be set.
+type DNSUpdateConfig struct {
+	// Type of updater, "rfc2136" or "coredns-hosts"
+	Type string `json:"type"`
+	// TTL of the DNS records (rfc2136), e.g. "5m"
+	TTL string `json:"ttl,omitempty"`
+
+	// Address of the DNS server that accepts dynamic updates (rfc2136), e.g. "10.0.0.10:53"
+	Server string `json:"server,omitempty"`
+	// Zone containing the forward (A) records (rfc2136), e.g. "example.local"
+	Zone string `json:"zone,omitempty"`
+	// Zone containing the reverse (PTR) records (rfc2136), e.g. "10.168.192.in-addr.arpa".
+	// Defaults to the /24 reverse zone of the address.
+	ReverseZone string `json:"reverse-zone,omitempty"`
+	// TSIG key used to sign dynamic updates (rfc2136)
+	TSIG *TSIGConfig `json:"tsig,omitempty"`
+
+	// Name of the ConfigMap containing the hosts file (coredns-hosts)
+	ConfigMap string `json:"config-map,omitempty"`
+	// Namespace of the ConfigMap (coredns-hosts), defaults to the namespace of the server
+	Namespace string `json:"namespace,omitempty"`
+	// Data key of the hosts file in the ConfigMap (coredns-hosts), defaults to "hosts"
+	Key string `json:"key,omitempty"`
+}
+
+// Validate changes the values in the given config.
+// Returns nil if all ok, otherwise an error.
+func (c *DNSUpdateConfig) Validate() error {
+	if c.TTL != "" {
+		if d, err := time.ParseDuration(c.TTL); err != nil || d < time.Second {
+			return maskAny(fmt.Errorf("Failed to parse dns-update ttl '%s'", c.TTL))
+		}
+	}
+	switch c.Type {
+	case dnsUpdaterRFC2136:
+		if c.Server == "" {
+			return maskAny(fmt.Errorf("Dns-update of type '%s' must have a server", c.Type))
+		}
+		if c.Zone == "" {
+			return maskAny(fmt.Errorf("Dns-update of type '%s' must have a zone", c.Type))
+		}
+		c.Zone = canonicalDomainName(c.Zone)
+		c.ReverseZone = canonicalDomainName(c.ReverseZone)
+		if c.TSIG != nil {
+			if err := c.TSIG.Validate(); err != nil {
+				return maskAny(err)
+			}
+		}
+	case dnsUpdaterCoreDNSHosts:
+		if c.ConfigMap == "" {
+			return maskAny(fmt.Errorf("Dns-update of type '%s' must have a config-map", c.Type))
+		}
+		if c.Key == "" {
+			c.Key = "hosts"
+		}
+	default:
+		return maskAny(fmt.Errorf("Unknown dns-update type '%s'", c.Type))
+	}
+	return nil
+}
+
+// GetTTL returns the TTL of the DNS records.
+func (c DNSUpdateConfig) GetTTL() time.Duration {
+	return parseDurationOr(c.TTL, defaultDNSTTL)
+}
+
+// DNSUpdater registers leased hosts in DNS.
+type DNSUpdater interface {
+	// Add (or replace) the forward and reverse records of the given lease.
+	Update(l Lease) error
+	// Remove the forward and reverse records of the given lease.
+	Remove(l Lease) error
+}
+
+// NewDNSUpdater creates a DNSUpdater for the given config.
+// Returns nil if the config is nil.
+func NewDNSUpdater(config *DNSUpdateConfig, client *k8s.Client, namespace string) (DNSUpdater, error) {
+	if config == nil {
+		return nil, nil
+	}
+	switch config.Type {
+	case dnsUpdaterRFC2136:
+		return NewRFC2136DNSUpdater(*config)
+	case dnsUpdaterCoreDNSHosts:
+		if config.Namespace != "" {
+			namespace = config.Namespace
+		}
+		return NewCoreDNSHostsUpdater(client, config.ConfigMap, namespace, config.Key), nil
+	default:
+		return nil, maskAny(fmt.Errorf("Unknown dns-update type '%s'", config.Type))
+	}
+}
+
+// dnsLeaseRegistry is a LeaseRegistry that keeps the DNS records of bound leases
+// up to date, while storing the leases in another registry.
+// DNS records of created and removed leases are updated in the background, in order,
+// so a slow or unreachable DNS server does not delay the replies to clients.
+type dnsLeaseRegistry struct {
+	LeaseRegistry
+	updater DNSUpdater
+
+	mutex   sync.Mutex
+	cleaned map[string]time.Time // IP -> expiration time of expired leases of which the records are removed
+	queue   []func()             // Pending DNS updates
+	running bool                 // Set while the queue is being processed
+}
+
+// newDNSLeaseRegistry creates a LeaseRegistry that stores leases in the given registry
+// and registers the hosts of bound leases using the given updater.
+func newDNSLeaseRegistry(leases LeaseRegistry, updater DNSUpdater) *dnsLeaseRegistry {
+	return &dnsLeaseRegistry{
+		LeaseRegistry: leases,
+		updater:       updater,
+		cleaned:       make(map[string]time.Time),
+	}
+}
+
+// Remove the given lease and its DNS records.
+func (r *dnsLeaseRegistry) Remove(l *Lease) error {
+	if err := r.LeaseRegistry.Remove(l); err != nil {
+		return maskAny(err)
+	}
+	if hasDNSRecords(*l) {
+		removed := *l
+		r.enqueue(func() { r.removeRecords(removed) })
+	}
+	return nil
+}
+
+// Create stores the given lease, expiring after the given time to live.
+// The DNS records of a previous lease for the same IP are removed, when
+// they differ from the records of the given lease.
+// The DNS records of the given lease are added (or refreshed) when it is bound.
+func (r *dnsLeaseRegistry) Create(l Lease, ttl time.Duration) (*Lease, error) {
+	previous, err := r.LeaseRegistry.GetByIP(l.IP)
+	if err != nil && !IsLeaseNotFound(err) {
+		return nil, maskAny(err)
+	}
+	result, err := r.LeaseRegistry.Create(l, ttl)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if previous != nil && hasDNSRecords(*previous) && (!hasDNSRecords(*result) || previous.FQDN != result.FQDN) {
+		removed := *previous
+		r.enqueue(func() { r.removeRecords(removed) })
+	}
+	if hasDNSRecords(*result) {
+		added := *result
+		r.enqueue(func() { r.addRecords(added) })
+	}
+	return result, nil
+}
+
+// enqueue adds the given DNS update to the queue and starts processing
+// the queue if needed.
+// The update is dropped when the queue is full.
+// Returns true if the update is queued, false if it is dropped.
+func (r *dnsLeaseRegistry) enqueue(update func()) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.queue) >= maxDNSQueueLength {
+		dnsUpdateFailures.Add(1)
+		log.Printf("DNS update queue is full, dropping update\n")
+		return false
+	}
+	r.queue = append(r.queue, update)
+	if !r.running {
+		r.running = true
+		go r.processQueue()
+	}
+	return true
+}
+
+// processQueue performs all queued DNS updates, until the queue is empty.
+func (r *dnsLeaseRegistry) processQueue() {
+	for {
+		r.mutex.Lock()
+		if len(r.queue) == 0 {
+			r.running = false
+			r.mutex.Unlock()
+			return
+		}
+		update := r.queue[0]
+		r.queue = r.queue[1:]
+		r.mutex.Unlock()
+
+		update()
+	}
+}
+
+// RemoveExpiredRecords removes the DNS records of all expired leases.
+// The records are removed through the update queue, so the removal is ordered
+// with the updates of renewed leases.
+func (r *dnsLeaseRegistry) RemoveExpiredRecords() {
+	list, err := r.LeaseRegistry.List()
+	if err != nil {
+		log.Printf("Failed to list leases: %v\n", err)
+		return
+	}
+	for _, l := range list {
+		if !hasDNSRecords(l) || !l.IsExpired() {
+			continue
+		}
+		r.mutex.Lock()
+		cleanedAt, found := r.cleaned[l.IP]
+		if found && cleanedAt.Equal(l.GetExpiresAt()) {
+			// Already removed or queued
+			r.mutex.Unlock()
+			continue
+		}
+		r.cleaned[l.IP] = l.GetExpiresAt()
+		r.mutex.Unlock()
+		expired := l
+		if !r.enqueue(func() { r.removeExpiredRecords(expired) }) {
+			r.uncleaned(expired)
+		}
+	}
+}
+
+// removeExpiredRecords removes the DNS records of the given expired lease,
+// unless the lease has been renewed since it was queued.
+func (r *dnsLeaseRegistry) removeExpiredRecords(l Lease) {
+	if current, err := r.LeaseRegistry.GetByIP(l.IP); err == nil && !current.IsExpired() {
+		// Renewed, its records are up to date
+		return
+	}
+	if !r.removeRecords(l) {
+		r.uncleaned(l)
+	}
+}
+
+// uncleaned forgets that the records of the given expired lease are removed,
+// so the removal is tried again.
+func (r *dnsLeaseRegistry) uncleaned(l Lease) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cleaned, l.IP)
+}
+
+// addRecords adds (or refreshes) the DNS records of the given lease.
+func (r *dnsLeaseRegistry) addRecords(l Lease) {
+	if err := r.updater.Update(l); err != nil {
+		dnsUpdateFailures.Add(1)
+		log.Printf("Failed to add DNS records of '%s' (%s): %v\n", l.FQDN, l.IP, err)
+		return
+	}
+	log.Printf("Added DNS records of '%s' (%s)\n", l.FQDN, l.IP)
+}
+
+// removeRecords removes the DNS records of the given lease.
+// Returns true on success, false otherwise.
+func (r *dnsLeaseRegistry) removeRecords(l Lease) bool {
+	if err := r.updater.Remove(l); err != nil {
+		dnsUpdateFailures.Add(1)
+		log.Printf("Failed to remove DNS records of '%s' (%s): %v\n", l.FQDN, l.IP, err)
+		return false
+	}
+	log.Printf("Removed DNS records of '%s' (%s)\n", l.FQDN, l.IP)
+	return true
+}
+
+// hasDNSRecords returns true if DNS records are registered for the given lease.
+func hasDNSRecords(l Lease) bool {
+	return l.FQDN != "" && l.GetState() == LeaseStateBound
+}
@@ -1,154 +1,637 @@
 package main
 
 import (
-	"context"
 	"log"
 	"math/rand"
 	"net"
+	"strings"
 	"time"
 
 	dhcp "github.com/krolaw/dhcp4"
 )
 
-// NewHandler creates a DHCP handler for the given config
-func NewHandler(config DHCPConfig) (*DHCPHandler, error) {
+// NewHandler creates a DHCP handler for the given config, storing leases
+// in the given registry.
+// If a DNS updater is given, the hosts of bound leases are registered with it.
+func NewHandler(config DHCPConfig, leases LeaseRegistry, dns DNSUpdater) (*DHCPHandler, error) {
 	handler := &DHCPHandler{
-		ip:             parseIP(config.ServerIP),
-		leaseDuration:  2 * time.Hour,
-		ranges:         config.Ranges,
-		defaultOptions: config.Options,
-		leases:         NewMemoryLeaseRegistry(),
+		ip:                parseIP(config.ServerIP),
+		offerTimeout:      config.GetOfferTimeout(),
+		declineQuarantine: config.GetDeclineQuarantine(),
+		probeTimeout:      config.GetPingTimeout(),
+		authoritative:     config.Authoritative,
+		clientMatch:       config.ClientMatch,
+		subnets:           config.AllSubnets(),
+		reservations:      config.Reservations,
+		classes:           config.Classes,
+		access:            config.Access,
+		leases:            leases,
 	}
-	return handler, nil
-}
-
-// Run the handler until the given context is canceled.
-func (h *DHCPHandler) Run(ctx context.Context) error {
-	l, err := net.ListenPacket("udp4", ":67")
-	if err != nil {
-		return maskAny(err)
+	if config.PingCheck {
+		handler.prober = NewICMPProber()
 	}
-	defer l.Close()
-
-	errors := make(chan error, 1)
-	go func() {
-		defer close(errors)
-		if err := dhcp.Serve(l, h); err != nil {
-			errors <- err
+	if dns != nil {
+		handler.dnsLeases = newDNSLeaseRegistry(leases, dns)
+		handler.leases = handler.dnsLeases
+		if config.DNSUpdate != nil {
+			handler.dnsZone = config.DNSUpdate.Zone
 		}
-	}()
-
-	select {
-	case err := <-errors:
-		return maskAny(err)
-	case <-ctx.Done():
-		// Context closed
-		return nil
 	}
+	return handler, nil
 }
 
 type DHCPHandler struct {
-	ip             net.IP // Server IP to use
-	defaultOptions DHCPOptions
-	ranges         []AddressRange
-	leaseDuration  time.Duration // Lease period
-	leases         LeaseRegistry
+	ip                net.IP         // Server IP to use
+	subnets           []SubnetConfig // Served subnets, the first one is the subnet of the server itself
+	reservations      []Reservation
+	classes           []ClientClass
+	access            *AccessConfig // If set, restricts the clients that are served
+	offerTimeout      time.Duration // Time an offered address is held for the client
+	declineQuarantine time.Duration // Time a declined address is not used
+	prober            Prober        // If set, used to check addresses before offering them
+	probeTimeout      time.Duration
+	authoritative     bool        // If set, requests for unknown clients and other networks are answered
+	clientMatch       ClientMatch // Strategy used to decide to which client a lease belongs
+	leases            LeaseRegistry
+	dnsLeases         *dnsLeaseRegistry // If set, leases is wrapped to register hosts in DNS
+	dnsZone           string            // Zone in which hosts are registered, besides the domains of the subnets
 }
 
-// ServeDHCP serves DHCP requests.
+const (
+	// maxProbeAttempts is the maximum number of addresses probed for a single request.
+	maxProbeAttempts = 3
+)
+
+// ServeDHCP serves DHCP requests received on an unknown interface.
 func (h *DHCPHandler) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	return h.ServeDHCPIf(p, msgType, options, 0)
+}
+
+// ServeDHCPIf serves DHCP requests received on the interface with given index.
+// An interface index of 0 means that the interface is unknown.
+func (h *DHCPHandler) ServeDHCPIf(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options, ifIndex int) (d dhcp.Packet) {
+	if p.GIAddr().Equal(net.IPv4zero) {
+		// Relay agent information is only trusted in relayed packets (RFC 3046 section 2.1)
+		delete(options, dhcp.OptionRelayAgentInformation)
+	}
+	relayInfo := parseRelayAgentInfo(options)
+	classes := h.matchClasses(p, options, relayInfo)
+	if msgType == dhcp.Inform {
+		return h.serveInform(p, options, relayInfo, classes)
+	}
+	subnet := h.selectSubnet(p, relayInfo, ifIndex)
+	if subnet == nil {
+		log.Printf("%s: No subnet found for giaddr=%s nic=%s\n", msgType, p.GIAddr(), p.CHAddr())
+		return nil
+	}
+
+	if msgType == dhcp.Discover && !h.isAllowed(p, options, subnet, relayInfo) {
+		deniedClients.Add(1)
+		log.Printf("Discover: nic=%s denied by access policy\n", p.CHAddr())
+		return nil
+	}
+
 	switch msgType {
 
 	case dhcp.Discover:
-		ip, nic := "", p.CHAddr().String()
-		log.Printf("Discover: ip=%s nic=%s options=%v\n", ip, nic, options)
-		// Find current leases
-		if list, err := h.leases.ListByCHAddr(nic); err == nil && len(list) > 0 {
-			ip = list[0].IP
+		ip, nic, clientID := "", p.CHAddr().String(), clientIDFromOptions(options)
+		log.Printf("Discover: ip=%s nic=%s client-id=%s subnet=%s classes=%v options=%v\n", ip, nic, clientID, subnet.Subnet, classes, options)
+		reservation := h.findReservation(subnet, nic, clientID, relayInfo)
+		var current *Lease
+		if reservation != nil {
+			// Client has a fixed address, unless another client still holds it
+			if l := h.heldByOther(reservation.IP, nic, clientID); l != nil {
+				log.Printf("Discover: reserved ip=%s for nic=%s is still held by %s, not offering it\n", reservation.IP, nic, l.CHAddr)
+				return nil
+			}
+			ip = reservation.IP
+		} else if list, err := h.clientLeases(nic, clientID); err == nil {
+			// Use current (offered or bound) lease in this subnet
+			for i, l := range list {
+				if lip := parseIP(l.IP); lip != nil && subnet.IsAvailableFor(lip, relayInfo, classes) && !h.isReserved(l.IP) {
+					ip = l.IP
+					current = &list[i]
+					break
+				}
+			}
 		}
 		if ip == "" {
-			ip = h.findFreeLease()
+			ip = h.findUnusedLease(subnet, relayInfo, classes)
+		}
+		if ip != "" && reservation == nil && (current == nil || current.GetState() != LeaseStateBound || current.IsExpired()) {
+			// Hold the address for this client until it requests it
+			if _, err := h.leases.Create(Lease{IP: ip, CHAddr: nic, ClientID: clientID, State: LeaseStateOffered}, h.offerTimeout); IsLeaseConflict(err) {
+				log.Printf("Discover: ip=%s was taken by another client, not offering it\n", ip)
+				return nil
+			} else if err != nil {
+				log.Printf("Failed to create offered lease for IP '%s': %v\n", ip, err)
+				return nil
+			}
 		}
 		if ip != "" {
 			ip4 := parseIP(ip)
-			replyOpts := h.buildOptions(ip4)
+			replyOpts := h.buildOptions(ip4, subnet, reservation, classes, options)
 			log.Printf("Discover: Offering ip=%s options=%v\n", ip, replyOpts)
-			return dhcp.ReplyPacket(p, dhcp.Offer, h.ip, ip4, h.leaseDuration,
-				replyOpts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+			leaseTime, timers := h.leaseTimes(subnet, ip4, options)
+			res := h.reply(p, options, dhcp.Offer, ip4, leaseTime,
+				append(replyOpts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]), timers...))
+			h.setBootFields(res, subnet, options)
+			return res
 		}
 		log.Println("Discover: No free IP found")
 
 	case dhcp.Request:
-		log.Printf("Request: nic=%s options=%v\n", p.CHAddr().String(), options)
+		return h.serveRequest(p, options, subnet, relayInfo, classes)
+
+	case dhcp.Decline:
+		nic, clientID := p.CHAddr().String(), clientIDFromOptions(options)
 		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.ip) {
 			return nil // Message not for this dhcp server
 		}
-		reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
-		if reqIP == nil {
-			reqIP = net.IP(p.CIAddr())
-		}
-
-		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
-			if h.isInRange(reqIP) {
-				ip := reqIP.String()
-				chAddr := p.CHAddr().String()
-				l, err := h.leases.GetByIP(ip)
-				if IsLeaseNotFound(err) || ((err == nil) && l.CHAddr == chAddr) {
-					_, err := h.leases.Create(ip, chAddr, h.leaseDuration)
-					if err == nil {
-						replyOpts := h.buildOptions(reqIP)
-						return dhcp.ReplyPacket(p, dhcp.ACK, h.ip, reqIP, h.leaseDuration,
-							replyOpts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
-					}
-					log.Printf("Failed to create lease for IP '%s': %v\n", ip, err)
-				}
+		declinedIP := net.IP(options[dhcp.OptionRequestedIPAddress])
+		if len(declinedIP) != 4 || !subnet.Contains(declinedIP) {
+			log.Printf("Decline: nic=%s without valid requested ip\n", nic)
+			return nil
+		}
+		ip := declinedIP.String()
+		if l, err := h.leases.GetByIP(ip); err == nil && !h.clientMatch.Owns(*l, nic, clientID) && !l.IsExpired() {
+			log.Printf("Decline: nic=%s declined ip=%s leased by %s, ignoring\n", nic, ip, l.CHAddr)
+			return nil
+		}
+		// The address is in use by an unknown host, quarantine it
+		if _, err := h.leases.Create(Lease{IP: ip, State: LeaseStateQuarantined}, h.declineQuarantine); err != nil {
+			log.Printf("Failed to quarantine IP '%s': %v\n", ip, err)
+			return nil
+		}
+		declinedAddresses.Add(1)
+		log.Printf("Decline: nic=%s declined ip=%s, quarantined for %s\n", nic, ip, h.declineQuarantine)
+
+	case dhcp.Release:
+		ip, nic, clientID := net.IP(p.CIAddr()).String(), p.CHAddr().String(), clientIDFromOptions(options)
+		log.Printf("Release: ip=%s nic=%s client-id=%s\n", ip, nic, clientID)
+		if server, ok := options[dhcp.OptionServerIdentifier]; ok && !net.IP(server).Equal(h.ip) {
+			return nil // Message not for this dhcp server
+		}
+		// Only release the lease of the address given in ciaddr
+		l, err := h.leases.GetByIP(ip)
+		if IsLeaseNotFound(err) {
+			log.Printf("Release: No lease found for ip=%s\n", ip)
+			return nil
+		} else if err != nil {
+			log.Printf("Failed to get lease for '%s': %v\n", ip, err)
+			return nil
+		}
+		if l.GetState() != LeaseStateBound || !h.clientMatch.Owns(*l, nic, clientID) {
+			log.Printf("Release: ip=%s is not leased by nic=%s, ignoring\n", ip, nic)
+			return nil
+		}
+		if err := h.leases.Remove(l); err != nil {
+			log.Printf("Failed to remove lease '%s': %v\n", l.IP, err)
+		}
+	}
+	return nil
+}
+
+// Client states in which a DHCPREQUEST is sent (RFC 2131 section 4.3.2)
+const (
+	requestSelecting  = "SELECTING"
+	requestInitReboot = "INIT-REBOOT"
+	// Renewing (unicast) and rebinding (broadcast) requests are handled the same.
+	requestRenewing = "RENEWING/REBINDING"
+)
+
+// serveRequest serves a DHCPREQUEST received from a client in the given subnet.
+// The state of the client is derived from the server identifier, requested IP
+// address and ciaddr fields (RFC 2131 section 4.3.2).
+func (h *DHCPHandler) serveRequest(p dhcp.Packet, options dhcp.Options, subnet *SubnetConfig, relayInfo *RelayAgentInfo, classes []string) dhcp.Packet {
+	nic, clientID := p.CHAddr().String(), clientIDFromOptions(options)
+	serverID, hasServerID := options[dhcp.OptionServerIdentifier]
+	reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
+	hasReqIP := len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero)
+	ciAddr := copyIP(p.CIAddr())
+	hasCIAddr := !ciAddr.Equal(net.IPv4zero)
+
+	var state string
+	switch {
+	case hasServerID:
+		if !net.IP(serverID).Equal(h.ip) {
+			// Client selected the offer of another server
+			log.Printf("Request: nic=%s selected server %s\n", nic, net.IP(serverID))
+			h.withdrawOffers(nic, clientID)
+			return nil
+		}
+		if !hasReqIP {
+			log.Printf("Request: nic=%s in SELECTING state without requested ip, ignoring\n", nic)
+			return nil
+		}
+		state = requestSelecting
+	case hasReqIP && !hasCIAddr:
+		state = requestInitReboot
+	case hasCIAddr:
+		state = requestRenewing
+		reqIP = ciAddr
+	default:
+		log.Printf("Request: nic=%s without requested ip or ciaddr, ignoring\n", nic)
+		return nil
+	}
+	ip := reqIP.String()
+	log.Printf("Request: state=%s ip=%s nic=%s classes=%v options=%v\n", state, ip, nic, classes, options)
+
+	if !h.isAllowed(p, options, subnet, relayInfo) {
+		deniedClients.Add(1)
+		log.Printf("Request: nic=%s denied by access policy\n", nic)
+		if h.access.Action == accessActionNAK && (state == requestSelecting || h.authoritative || h.hasLease(ip, nic, clientID)) {
+			// Request is addressed to this server
+			return h.nak(p, options)
+		}
+		return nil
+	}
+
+	if !subnet.Contains(reqIP) {
+		// Address is on the wrong network
+		if state == requestSelecting || h.authoritative {
+			return h.nak(p, options)
+		}
+		return nil
+	}
+
+	reservation := h.findReservation(subnet, nic, clientID, relayInfo)
+	var allowed bool
+	if reservation != nil {
+		// Client can only get its reserved address
+		allowed = reservation.IP == ip
+	} else {
+		allowed = subnet.IsAvailableFor(reqIP, relayInfo, classes) && !h.isExcluded(reqIP) && !h.isReserved(ip)
+	}
+	if !allowed {
+		return h.nak(p, options)
+	}
+
+	l, err := h.leases.GetByIP(ip)
+	if err != nil && !IsLeaseNotFound(err) {
+		// Let the client try again later
+		log.Printf("Failed to get lease for IP '%s': %v\n", ip, err)
+		return nil
+	}
+	hasRecord := err == nil && !l.IsExpired() && h.clientMatch.Owns(*l, nic, clientID)
+	if err == nil && !l.IsExpired() && !hasRecord {
+		// Address is in use by another host
+		if reservation != nil {
+			log.Printf("Request: reserved ip=%s for nic=%s is still held by %s\n", ip, nic, l.CHAddr)
+		}
+		return h.nak(p, options)
+	}
+	if !hasRecord && state != requestSelecting && !h.authoritative {
+		// We have no record of this client, leave it to the authoritative server
+		return nil
+	}
+
+	leaseTime, timers := h.leaseTimes(subnet, reqIP, options)
+	hostname, fqdn := h.clientNames(reqIP, subnet, reservation, nic, clientID, options)
+	lease := Lease{
+		IP:       ip,
+		CHAddr:   nic,
+		ClientID: clientID,
+		Hostname: hostname,
+		FQDN:     fqdn,
+		State:    LeaseStateBound,
+	}
+	if _, err := h.leases.Create(lease, leaseTime); IsLeaseConflict(err) {
+		// Address was taken by another client in the meantime
+		log.Printf("Request: ip=%s was taken by another client\n", ip)
+		return h.nak(p, options)
+	} else if err != nil {
+		log.Printf("Failed to create lease for IP '%s': %v\n", ip, err)
+		return nil
+	}
+	replyOpts := h.buildOptions(reqIP, subnet, reservation, classes, options)
+	extraOpts := timers
+	if clientFQDN := parseClientFQDN(options); clientFQDN != nil && hostname != "" {
+		extraOpts = append(extraOpts, h.clientFQDNOption(*clientFQDN, hostname, fqdn))
+	}
+	res := h.reply(p, options, dhcp.ACK, reqIP, leaseTime,
+		append(replyOpts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]), extraOpts...))
+	if hasCIAddr {
+		res.SetCIAddr(ciAddr)
+	}
+	h.setBootFields(res, subnet, options)
+	return res
+}
+
+// nak creates a DHCPNAK reply for the given request.
+// When the request is relayed, the broadcast bit is set, so the relay agent
+// broadcasts the reply to the client (RFC 2131 section 4.3.2).
+func (h *DHCPHandler) nak(p dhcp.Packet, options dhcp.Options) dhcp.Packet {
+	log.Printf("Request: NAK nic=%s\n", p.CHAddr())
+	res := h.reply(p, options, dhcp.NAK, nil, 0, nil)
+	if !p.GIAddr().Equal(net.IPv4zero) {
+		res.SetBroadcast(true)
+	}
+	return res
+}
+
+// withdrawOffers removes all offered leases of the client with given
+// hardware address and client identifier.
+func (h *DHCPHandler) withdrawOffers(nic, clientID string) {
+	list, err := h.clientLeases(nic, clientID)
+	if err != nil {
+		log.Printf("Failed to list leases for '%s': %v\n", nic, err)
+		return
+	}
+	for _, l := range list {
+		if l.GetState() == LeaseStateOffered {
+			if err := h.leases.Remove(&l); err != nil {
+				log.Printf("Failed to remove lease '%s': %v\n", l.IP, err)
 			}
 		}
-		return dhcp.ReplyPacket(p, dhcp.NAK, h.ip, nil, 0, nil)
+	}
+}
+
+// heldByOther returns the unexpired lease of the given IP, if that lease does not
+// belong to the client with given hardware address and client identifier.
+// Returns nil if the IP is not held by another client.
+func (h *DHCPHandler) heldByOther(ip, nic, clientID string) *Lease {
+	l, err := h.leases.GetByIP(ip)
+	if IsLeaseNotFound(err) {
+		return nil
+	} else if err != nil {
+		// Cannot tell, assume it is in use
+		log.Printf("Failed to get lease for IP '%s': %v\n", ip, err)
+		return &Lease{IP: ip}
+	}
+	if l.IsExpired() || h.clientMatch.Owns(*l, nic, clientID) {
+		return nil
+	}
+	return l
+}
+
+// hasLease returns true if the client with given hardware address and
+// client identifier has an unexpired lease for the given IP.
+func (h *DHCPHandler) hasLease(ip, nic, clientID string) bool {
+	l, err := h.leases.GetByIP(ip)
+	return err == nil && !l.IsExpired() && h.clientMatch.Owns(*l, nic, clientID)
+}
+
+// clientLeases returns all leases of the client with given hardware address
+// and client identifier (empty if the client did not send one).
+func (h *DHCPHandler) clientLeases(nic, clientID string) ([]Lease, error) {
+	var list []Lease
+	var err error
+	if clientID != "" && h.clientMatch != ClientMatchMAC {
+		list, err = h.leases.ListByClientID(clientID)
+	} else {
+		list, err = h.leases.ListByCHAddr(nic)
+	}
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	var result []Lease
+	for _, l := range list {
+		if h.clientMatch.Owns(l, nic, clientID) {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
 
-	case dhcp.Release, dhcp.Decline:
-		nic := p.CHAddr().String()
-		log.Printf("Release/Decline: nic=%s\n", nic)
-		leases, err := h.leases.ListByCHAddr(nic)
-		if err != nil {
-			log.Printf("Failed to list leases for '%s': %v\n", nic, err)
-		} else {
-			for _, l := range leases {
-				if err := h.leases.Remove(&l); err != nil {
-					log.Printf("Failed to remove lease '%s': %v\n", l.IP, err)
+// serveInform serves a DHCPINFORM request.
+// The client already has an address (ciaddr), it only wants to receive
+// the options of its subnet (RFC 2131 section 4.3.5).
+func (h *DHCPHandler) serveInform(p dhcp.Packet, options dhcp.Options, relayInfo *RelayAgentInfo, classes []string) dhcp.Packet {
+	ciAddr, nic := copyIP(p.CIAddr()), p.CHAddr().String()
+	log.Printf("Inform: ip=%s nic=%s options=%v\n", ciAddr, nic, options)
+	subnet := h.findSubnet(ciAddr)
+	if subnet == nil {
+		log.Printf("Inform: No subnet found for ip=%s\n", ciAddr)
+		return nil
+	}
+	reservation := h.findReservation(subnet, nic, clientIDFromOptions(options), relayInfo)
+	if reservation != nil && reservation.IP != ciAddr.String() {
+		// Reservation is for another address, do not use its options
+		reservation = nil
+	}
+	replyOpts := h.buildOptions(ciAddr, subnet, reservation, classes, options)
+	// No yiaddr & no lease time
+	res := h.reply(p, options, dhcp.ACK, nil, 0,
+		replyOpts.SelectOrderOrAll(options[dhcp.OptionParameterRequestList]))
+	res.SetCIAddr(ciAddr)
+	return res
+}
+
+// RemoveExpiredDNSRecords removes the DNS records of all expired leases,
+// if hosts are registered in DNS.
+func (h *DHCPHandler) RemoveExpiredDNSRecords() {
+	if h.dnsLeases != nil {
+		h.dnsLeases.RemoveExpiredRecords()
+	}
+}
+
+// ReportLeasesOutOfRange logs all unexpired leases that are not part of
+// the ranges of this handler.
+// These leases are kept until they expire, but will not be renewed.
+func (h *DHCPHandler) ReportLeasesOutOfRange() {
+	leases, err := h.leases.List()
+	if err != nil {
+		log.Printf("Failed to list leases: %v\n", err)
+		return
+	}
+	for _, l := range leases {
+		if l.IsExpired() {
+			continue
+		}
+		if ip := parseIP(l.IP); ip == nil || (!h.isInRange(ip) && !h.isReserved(l.IP)) {
+			log.Printf("Lease for IP '%s' (nic=%s) is out of range, it will expire at %s\n", l.IP, l.CHAddr, l.GetExpiresAt())
+		}
+	}
+}
+
+// reply creates a reply packet for the given request.
+// Options that do not fit in a single option instance are split (RFC 3396).
+// The relay agent information option of the request is echoed as required by RFC 3046.
+func (h *DHCPHandler) reply(req dhcp.Packet, reqOptions dhcp.Options, mt dhcp.MessageType, yIAddr net.IP, leaseDuration time.Duration, options []dhcp.Option) dhcp.Packet {
+	options = splitLongOptions(options)
+	if info, ok := reqOptions[dhcp.OptionRelayAgentInformation]; ok {
+		options = append(options, dhcp.Option{Code: dhcp.OptionRelayAgentInformation, Value: info})
+	}
+	return dhcp.ReplyPacket(req, mt, h.ip, yIAddr, leaseDuration, options)
+}
+
+// leaseTimes returns the lease time for the given IP in the given subnet,
+// taking the lease time requested by the client into account,
+// together with the renewal (T1) and rebinding (T2) time options.
+func (h *DHCPHandler) leaseTimes(subnet *SubnetConfig, ip net.IP, reqOptions dhcp.Options) (time.Duration, []dhcp.Option) {
+	times := subnet.GetLeaseTimes(ip)
+	leaseTime := times.GetLeaseTime(requestedLeaseTime(reqOptions))
+	return leaseTime, timerOptions(times.GetTimers(leaseTime))
+}
+
+// selectSubnet returns the subnet from which an address must be given to the
+// client that sent the given packet.
+// If the relay agent specified a link selection, this is the subnet that contains that address.
+// For other relayed packets, this is the subnet that contains the relay agent address.
+// Packets of clients that already have an address (ciaddr), such as renewals sent
+// directly to the server, use the subnet that contains that address.
+// For other packets, this is the subnet that contains one of the addresses of
+// the receiving interface, or the subnet of the server itself if the interface is unknown.
+// Returns nil if no subnet is found.
+func (h *DHCPHandler) selectSubnet(p dhcp.Packet, relayInfo *RelayAgentInfo, ifIndex int) *SubnetConfig {
+	if relayInfo != nil && relayInfo.LinkSelection != nil {
+		return h.findSubnet(relayInfo.LinkSelection)
+	}
+	if giAddr := p.GIAddr(); !giAddr.Equal(net.IPv4zero) {
+		return h.findSubnet(giAddr)
+	}
+	if ciAddr := p.CIAddr(); !ciAddr.Equal(net.IPv4zero) {
+		if s := h.findSubnet(ciAddr); s != nil {
+			return s
+		}
+	}
+	if ifIndex > 0 {
+		if iface, err := net.InterfaceByIndex(ifIndex); err == nil {
+			if addrs, err := iface.Addrs(); err == nil {
+				for _, addr := range addrs {
+					if ipNet, ok := addr.(*net.IPNet); ok {
+						if s := h.findSubnet(ipNet.IP); s != nil {
+							return s
+						}
+					}
 				}
 			}
 		}
+		// Interface is not connected to a served subnet
+		return nil
+	}
+	return &h.subnets[0]
+}
+
+// findSubnet returns the subnet that contains the given IP, or nil if
+// there is no such subnet.
+func (h *DHCPHandler) findSubnet(ip net.IP) *SubnetConfig {
+	for i, s := range h.subnets {
+		if s.Contains(ip) {
+			return &h.subnets[i]
+		}
+	}
+	return nil
+}
+
+// isAllowed returns true if the client that sent the given request in the given
+// subnet is served according to the access policy.
+func (h *DHCPHandler) isAllowed(p dhcp.Packet, options dhcp.Options, subnet *SubnetConfig, relayInfo *RelayAgentInfo) bool {
+	if h.access == nil {
+		return true
+	}
+	known := h.findReservation(subnet, p.CHAddr().String(), clientIDFromOptions(options), relayInfo) != nil
+	return h.access.IsAllowed(p.CHAddr(), known)
+}
+
+// matchClasses returns the names of all classes the client that sent
+// the given request is a member of.
+func (h *DHCPHandler) matchClasses(p dhcp.Packet, options dhcp.Options, relayInfo *RelayAgentInfo) []string {
+	var result []string
+	for _, c := range h.classes {
+		if c.Match.Matches(p.CHAddr(), options, relayInfo) {
+			result = append(result, c.Name)
+		}
+	}
+	return result
+}
+
+// findReservation returns the reservation in the given subnet for the client with
+// given hardware address, client identifier and relay agent information,
+// or nil if there is no such reservation.
+func (h *DHCPHandler) findReservation(subnet *SubnetConfig, chAddr, clientID string, relayInfo *RelayAgentInfo) *Reservation {
+	for i, r := range h.reservations {
+		if subnet.Contains(parseIP(r.IP)) && r.Matches(chAddr, clientID, relayInfo) {
+			return &h.reservations[i]
+		}
 	}
 	return nil
 }
 
-// isInRange returns true when the given IP fits in one of the given address ranges.
+// isReserved returns true when the given IP is reserved for a specific client.
+func (h *DHCPHandler) isReserved(ip string) bool {
+	for _, r := range h.reservations {
+		if r.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// isInRange returns true when the given IP fits in one of the address ranges
+// of one of the subnets and is not excluded.
 func (h *DHCPHandler) isInRange(ip net.IP) bool {
-	for _, r := range h.ranges {
-		if r.Contains(ip) {
+	if h.isExcluded(ip) {
+		return false
+	}
+	for _, s := range h.subnets {
+		if s.IsInRange(ip) {
 			return true
 		}
 	}
 	return false
 }
 
-// findFreeLease tries to find a free IP address.
+// isExcluded returns true when the given IP must never be assigned dynamically,
+// regardless of the subnet configuration.
+func (h *DHCPHandler) isExcluded(ip net.IP) bool {
+	return ip.Equal(h.ip)
+}
+
+// findUnusedLease tries to find a free IP address in the given subnet, like findFreeLease.
+// If a prober is set, the address is probed first. Addresses that are found
+// to be in use are quarantined and another address is tried.
+// Returns an empty string if no free, unused address is found.
+func (h *DHCPHandler) findUnusedLease(subnet *SubnetConfig, relayInfo *RelayAgentInfo, classes []string) string {
+	for attempt := 0; attempt < maxProbeAttempts; attempt++ {
+		ip := h.findFreeLease(subnet, relayInfo, classes)
+		if ip == "" || h.prober == nil {
+			return ip
+		}
+		inUse, err := h.prober.IsInUse(parseIP(ip), h.probeTimeout)
+		if err != nil {
+			log.Printf("Failed to probe IP '%s': %v\n", ip, err)
+			return ip
+		}
+		if !inUse {
+			return ip
+		}
+		// Address is used by an unknown host, quarantine it
+		conflictingAddresses.Add(1)
+		log.Printf("IP '%s' is in use by an unknown host, quarantined for %s\n", ip, h.declineQuarantine)
+		if _, err := h.leases.Create(Lease{IP: ip, State: LeaseStateQuarantined}, h.declineQuarantine); err != nil {
+			log.Printf("Failed to quarantine IP '%s': %v\n", ip, err)
+		}
+	}
+	return ""
+}
+
+// findFreeLease tries to find a free IP address in the given subnet,
+// in a range that can be used by a client with given relay agent information and classes.
 // Returns an empty string if no free address is found.
-func (h *DHCPHandler) findFreeLease() string {
-	rangePerms := rand.Perm(len(h.ranges))
+func (h *DHCPHandler) findFreeLease(subnet *SubnetConfig, relayInfo *RelayAgentInfo, classes []string) string {
+	rangePerms := rand.Perm(len(subnet.Ranges))
 	for _, rIdx := range rangePerms {
-		r := h.ranges[rIdx]
+		r := subnet.Ranges[rIdx]
+		if !r.AllowsClient(relayInfo, classes) {
+			continue
+		}
+		// Walk the range from a random offset, without allocating a permutation of large ranges
 		start := parseIP(r.Start)
-		offsetPerm := rand.Perm(r.Length)
-		for _, ofs := range offsetPerm {
-			ip := dhcp.IPAdd(start, ofs).String()
+		first := rand.Intn(r.Length)
+		for i := 0; i < r.Length; i++ {
+			ip4 := dhcp.IPAdd(start, (first+i)%r.Length)
+			ip := ip4.String()
+			if subnet.IsExcluded(ip4) || h.isExcluded(ip4) || h.isReserved(ip) {
+				continue
+			}
 			l, err := h.leases.GetByIP(ip)
 			if IsLeaseNotFound(err) {
 				return ip
 			}
 			if err == nil && l.IsExpired() {
-				// Existing lease is expired
+				// Existing lease (bound or quarantined) is expired
 				err := h.leases.Remove(l)
 				if err == nil {
 					return l.IP
@@ -160,23 +643,203 @@ func (h *DHCPHandler) findFreeLease() string {
 	return ""
 }
 
-// buildOptions creates a set of options for the given IP.
-func (h *DHCPHandler) buildOptions(ip net.IP) dhcp.Options {
+// setBootFields sets the next server and boot file fields of the given response
+// when the request (with given options) was sent by a network boot client.
+func (h *DHCPHandler) setBootFields(res dhcp.Packet, subnet *SubnetConfig, reqOptions dhcp.Options) {
+	boot := subnet.Boot
+	if boot == nil || !isNetworkBootClient(reqOptions) {
+		return
+	}
+	if boot.NextServer != "" {
+		res.SetSIAddr(parseIP(boot.NextServer))
+	}
+	if filename := boot.SelectFilename(reqOptions); filename != "" {
+		res.SetFile([]byte(filename))
+	}
+}
+
+// assignedHostname returns the hostname assigned by the server to the client
+// that gets the given IP, or an empty string if the server does not assign a hostname.
+// The hostname of a reservation takes precedence over the hostname template of the subnet.
+func (h *DHCPHandler) assignedHostname(ip net.IP, subnet *SubnetConfig, reservation *Reservation) string {
+	if reservation != nil && reservation.Hostname != "" {
+		return reservation.Hostname
+	}
+	if subnet.HostnameTemplate != "" {
+		return expandHostnameTemplate(subnet.HostnameTemplate, ip)
+	}
+	return ""
+}
+
+// clientNames returns the hostname and FQDN of the client with given hardware address
+// and client identifier, that sent the given options and gets the given IP.
+// A hostname assigned by the server takes precedence over the hostname sent by the client.
+// The FQDN is the hostname in the domain of the subnet, or the FQDN sent by the
+// client if the server did not assign a hostname, it is a valid domain name and it is in
+// that domain or in the DNS zone.
+// A name sent by the client is not given a FQDN when it is in use by another host.
+func (h *DHCPHandler) clientNames(ip net.IP, subnet *SubnetConfig, reservation *Reservation, nic, clientID string, reqOptions dhcp.Options) (string, string) {
+	domain := canonicalDomainName(subnet.GetOptions(ip).DomainName)
+	if reservation != nil && reservation.Options.DomainName != "" {
+		domain = canonicalDomainName(reservation.Options.DomainName)
+	}
+	hostname := h.assignedHostname(ip, subnet, reservation)
+	if hostname != "" {
+		if domain == "" {
+			return hostname, ""
+		}
+		return hostname, hostname + "." + domain
+	}
+	hostname = clientHostname(reqOptions)
+	if hostname == "" {
+		return "", ""
+	}
+	var fqdn string
+	if clientFQDN := parseClientFQDN(reqOptions); clientFQDN != nil && clientFQDN.Qualified {
+		name := canonicalDomainName(clientFQDN.Name)
+		if validateDomainName(name) == nil && (isInDomain(name, domain) || isInDomain(name, h.dnsZone)) {
+			fqdn = name
+		}
+	}
+	if fqdn == "" && domain != "" {
+		fqdn = hostname + "." + domain
+	}
+	if fqdn != "" {
+		if taken, err := h.isNameTaken(hostname, fqdn, ip.String(), nic, clientID); err != nil {
+			log.Printf("Failed to check if name '%s' of nic=%s is in use, not registering it: %v\n", fqdn, nic, err)
+			return hostname, ""
+		} else if taken {
+			log.Printf("Name '%s' of nic=%s is in use by another host, not registering it\n", fqdn, nic)
+			return hostname, ""
+		}
+	}
+	return hostname, fqdn
+}
+
+// isNameTaken returns true if the given hostname or FQDN is in use by a host other than
+// the client with given hardware address and client identifier that gets the given IP.
+// This is the case for the hostname of a reservation for another IP, and for the FQDN
+// of an unexpired bound lease of another client.
+func (h *DHCPHandler) isNameTaken(hostname, fqdn, ip, nic, clientID string) (bool, error) {
+	for _, r := range h.reservations {
+		if r.IP != ip && strings.EqualFold(r.Hostname, hostname) {
+			return true, nil
+		}
+	}
+	list, err := h.leases.ListByFQDN(fqdn)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	for _, l := range list {
+		if l.IP != ip && l.GetState() == LeaseStateBound && !l.IsExpired() && !h.clientMatch.Owns(l, nic, clientID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isInDomain returns true if the given name is a name in the given domain.
+func isInDomain(name, domain string) bool {
+	return domain != "" && strings.HasSuffix(name, "."+domain)
+}
+
+// clientFQDNOption creates the client FQDN option (81) in reply to the given
+// client FQDN option, for a client with given hostname and FQDN (RFC 4702 section 4).
+// When the server registers hosts in DNS, it updates the A record, otherwise it
+// performs no updates. Either way, it overrides a client with another preference.
+func (h *DHCPHandler) clientFQDNOption(clientFQDN ClientFQDN, hostname, fqdn string) dhcp.Option {
+	var flags byte
+	if h.dnsLeases != nil && fqdn != "" {
+		flags = fqdnFlagS
+		if clientFQDN.Flags&fqdnFlagS == 0 {
+			flags |= fqdnFlagO
+		}
+	} else {
+		flags = fqdnFlagN
+		if clientFQDN.Flags&fqdnFlagS != 0 {
+			flags |= fqdnFlagO
+		}
+	}
+	name := fqdn
+	if name == "" {
+		name = hostname
+	}
+	return dhcp.Option{Code: optionClientFQDN, Value: clientFQDN.Encode(flags, name)}
+}
+
+// buildOptions creates a set of options for the given IP in the given subnet,
+// for a request with given options.
+// The options of the range containing the IP override the options of the subnet.
+// The options of the given classes override those, in the order the classes are configured.
+// If a reservation is given, its options override those.
+// The vendor-specific information option (43) is created from the vendor sub-options
+// of the given classes, which are selected by the vendor class (option 60) of the client.
+func (h *DHCPHandler) buildOptions(ip net.IP, subnet *SubnetConfig, reservation *Reservation, classes []string, reqOptions dhcp.Options) dhcp.Options {
 	options := make(dhcp.Options)
-	config := h.defaultOptions
-	subnetMask := config.SubnetMask
-	if subnetMask == "" {
-		subnetMask = "255.255.255.0"
+	config := subnet.GetOptions(ip)
+	var vendorOptions []VendorSubOption
+	for _, c := range h.classes {
+		if hasClass(classes, c.Name) {
+			config = config.Merge(c.Options)
+			vendorOptions = mergeVendorSubOptions(vendorOptions, c.VendorOptions)
+		}
+	}
+	if reservation != nil {
+		config = config.Merge(reservation.Options)
+	}
+	if hostname := h.assignedHostname(ip, subnet, reservation); hostname != "" {
+		options[dhcp.OptionHostName] = []byte(hostname)
+	}
+	if config.SubnetMask != "" {
+		options[dhcp.OptionSubnetMask] = parseIP(config.SubnetMask)
+	} else {
+		options[dhcp.OptionSubnetMask] = []byte(subnet.GetSubnet().Mask)
+	}
+	if data, err := encodeIPs(config.Routers); err == nil {
+		options[dhcp.OptionRouter] = data
 	}
-	options[dhcp.OptionSubnetMask] = parseIP(subnetMask)
-	if config.RouterIP != "" {
-		options[dhcp.OptionRouter] = parseIP(config.RouterIP)
+	if data, err := encodeIPs(config.DNSServers); err == nil {
+		options[dhcp.OptionDomainNameServer] = data
 	}
-	if config.DNSServerIP != "" {
-		options[dhcp.OptionDomainNameServer] = parseIP(config.DNSServerIP)
+	if data, err := encodeIPs(config.NTPServers); err == nil {
+		options[dhcp.OptionNetworkTimeProtocolServers] = data
+	}
+	if len(config.Routes) > 0 {
+		if data, err := encodeRoutes(config.routesWithDefault()); err == nil {
+			options[optionClasslessStaticRoute] = data
+			options[optionMSClasslessStaticRoute] = data
+		}
 	}
 	if config.DomainName != "" {
 		options[dhcp.OptionDomainName] = []byte(config.DomainName)
 	}
+	if len(config.DomainSearch) > 0 {
+		if data, err := encodeDomainList(config.DomainSearch); err == nil {
+			options[dhcp.OptionDomainSearch] = data
+		}
+	}
+	if boot := subnet.Boot; boot != nil && isNetworkBootClient(reqOptions) {
+		if boot.TFTPServer != "" {
+			options[dhcp.OptionTFTPServerName] = []byte(boot.TFTPServer)
+		}
+		if filename := boot.SelectFilename(reqOptions); filename != "" {
+			options[dhcp.OptionBootFileName] = []byte(filename)
+		}
+	}
+	for _, o := range config.Custom {
+		data, err := o.Encode()
+		if err != nil {
+			log.Printf("Failed to encode option %d: %v\n", o.Code, err)
+			continue
+		}
+		options[dhcp.OptionCode(o.Code)] = data
+	}
+	if len(vendorOptions) > 0 {
+		if data, err := encodeVendorSubOptions(vendorOptions); err != nil {
+			log.Printf("Failed to encode vendor-specific information: %v\n", err)
+		} else {
+			options[dhcp.OptionVendorSpecificInformation] = data
+		}
+	}
 	return options
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// newTestHandler creates a handler serving 192.168.10.0/24 directly and
+// 10.1.0.0/24 through a relay agent, storing leases in memory.
+func newTestHandler(t *testing.T) *DHCPHandler {
+	config := DHCPConfig{
+		ServerIP: "192.168.10.2",
+		SubnetConfig: SubnetConfig{
+			Subnet:  "192.168.10.0/24",
+			Ranges:  []AddressRange{{Start: "192.168.10.100", Length: 10}},
+			Options: DHCPOptions{RouterIP: "192.168.10.1", DNSServerIP: "192.168.10.2"},
+		},
+		Subnets: []SubnetConfig{{
+			Subnet:  "10.1.0.0/24",
+			Ranges:  []AddressRange{{Start: "10.1.0.100", Length: 10}},
+			Options: DHCPOptions{RouterIP: "10.1.0.1"},
+		}},
+	}
+	if err := config.Validate(""); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+	h, err := NewHandler(config, NewMemoryLeaseRegistry(), nil)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	return h
+}
+
+// testMAC is the hardware address of the client in tests.
+var testMAC = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// serveTestPacket creates a request of given type with given ciaddr and options and serves it.
+func serveTestPacket(h *DHCPHandler, mt dhcp.MessageType, ciAddr net.IP, options []dhcp.Option) dhcp.Packet {
+	p := dhcp.RequestPacket(mt, testMAC, ciAddr, []byte{1, 2, 3, 4}, false, options)
+	return h.ServeDHCP(p, mt, p.ParseOptions())
+}
+
+func TestInformAck(t *testing.T) {
+	h := newTestHandler(t)
+	ciAddr := net.IPv4(192, 168, 10, 50).To4()
+	res := serveTestPacket(h, dhcp.Inform, ciAddr, []dhcp.Option{
+		{Code: dhcp.OptionParameterRequestList, Value: []byte{byte(dhcp.OptionRouter), byte(dhcp.OptionDomainNameServer)}},
+	})
+	if res == nil {
+		t.Fatal("Expected a reply")
+	}
+	options := res.ParseOptions()
+	if mt := options[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != dhcp.ACK {
+		t.Errorf("Expected ACK, got %v", mt)
+	}
+	if !res.YIAddr().Equal(net.IPv4zero) {
+		t.Errorf("Expected yiaddr 0.0.0.0, got %s", res.YIAddr())
+	}
+	if !res.CIAddr().Equal(ciAddr) {
+		t.Errorf("Expected ciaddr %s, got %s", ciAddr, res.CIAddr())
+	}
+	for _, code := range []dhcp.OptionCode{dhcp.OptionIPAddressLeaseTime, dhcp.OptionRenewalTimeValue, dhcp.OptionRebindingTimeValue} {
+		if _, found := options[code]; found {
+			t.Errorf("Expected no option %d", code)
+		}
+	}
+	if router := net.IP(options[dhcp.OptionRouter]); !router.Equal(net.IPv4(192, 168, 10, 1)) {
+		t.Errorf("Expected router 192.168.10.1, got %s", router)
+	}
+	if len(listLeases(t, h)) != 0 {
+		t.Error("Expected no leases to be created")
+	}
+}
+
+func TestInformSubnetByCIAddr(t *testing.T) {
+	h := newTestHandler(t)
+	// Sent directly (no giaddr) by a client in the relayed subnet
+	res := serveTestPacket(h, dhcp.Inform, net.IPv4(10, 1, 0, 50).To4(), nil)
+	if res == nil {
+		t.Fatal("Expected a reply")
+	}
+	if router := net.IP(res.ParseOptions()[dhcp.OptionRouter]); !router.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("Expected router 10.1.0.1, got %s", router)
+	}
+}
+
+func TestInformUnknownCIAddr(t *testing.T) {
+	h := newTestHandler(t)
+	if res := serveTestPacket(h, dhcp.Inform, net.IPv4(172, 16, 0, 5).To4(), nil); res != nil {
+		t.Errorf("Expected no reply, got %v", res.ParseOptions())
+	}
+}
+
+// listLeases returns all leases of the given handler.
+func listLeases(t *testing.T, h *DHCPHandler) []Lease {
+	list, err := h.leases.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	return list
+}
+
+func TestClientNamesRejectsHostileFQDN(t *testing.T) {
+	h := newTestHandler(t)
+	h.subnets[0].Options.DomainName = "example.local"
+	ip := net.IPv4(192, 168, 10, 100).To4()
+	tests := []struct {
+		Value []byte
+		FQDN  string
+	}{
+		// Valid name in the domain
+		{append([]byte{0, 0, 0}, "host.sub.example.local"...), "host.sub.example.local"},
+		// Whitespace and newlines would inject records in a hosts file
+		{append([]byte{0, 0, 0}, "host.x y\n10.0.0.1 www.example.local"...), "host.example.local"},
+		{append([]byte{0, 0, 0}, "host.a_b.example.local"...), "host.example.local"},
+		// Wire format label containing a dot
+		{append([]byte{fqdnFlagE, 0, 0, 4, 'h', 'o', 's', 't', 5, 'a', '.', 'b', 'c', 'd', 7}, "example\x05local\x00"...), ""},
+		// Name outside the domain
+		{append([]byte{0, 0, 0}, "host.example.com"...), "host.example.local"},
+	}
+	for _, test := range tests {
+		options := dhcp.Options{optionClientFQDN: test.Value}
+		_, fqdn := h.clientNames(ip, &h.subnets[0], nil, testMAC.String(), "", options)
+		if fqdn != test.FQDN {
+			t.Errorf("Expected FQDN '%s' for %q, got '%s'", test.FQDN, test.Value[3:], fqdn)
+		}
+	}
+}
+
+func TestUnrelayedRelayAgentInfoIgnored(t *testing.T) {
+	h := newTestHandler(t)
+	// Link selection of the relayed subnet, sent without giaddr
+	res := serveTestPacket(h, dhcp.Discover, nil, []dhcp.Option{
+		{Code: dhcp.OptionRelayAgentInformation, Value: []byte{relayAgentLinkSelection, 4, 10, 1, 0, 1}},
+	})
+	if res == nil {
+		t.Fatal("Expected an offer")
+	}
+	if !h.subnets[0].Contains(res.YIAddr()) {
+		t.Errorf("Expected an offer in %s, got %s", h.subnets[0].Subnet, res.YIAddr())
+	}
+	if _, found := res.ParseOptions()[dhcp.OptionRelayAgentInformation]; found {
+		t.Error("Expected no relay agent information in the reply")
+	}
+}
+
+func TestSelectSubnetUnservedInterface(t *testing.T) {
+	h := newTestHandler(t)
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("No loopback interface: %v", err)
+	}
+	p := dhcp.RequestPacket(dhcp.Discover, testMAC, nil, []byte{1, 2, 3, 4}, false, nil)
+	if s := h.selectSubnet(p, nil, lo.Index); s != nil {
+		t.Errorf("Expected no subnet for interface %s, got %s", lo.Name, s.Subnet)
+	}
+	if s := h.selectSubnet(p, nil, 0); s != &h.subnets[0] {
+		t.Error("Expected the subnet of the server for an unknown interface")
+	}
+}
+
+func TestRequestStates(t *testing.T) {
+	serverID := dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 168, 10, 2}}
+	otherServerID := dhcp.Option{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 168, 10, 3}}
+	requestedIP := func(ip ...byte) dhcp.Option {
+		return dhcp.Option{Code: dhcp.OptionRequestedIPAddress, Value: ip}
+	}
+	own := Lease{IP: "192.168.10.105", CHAddr: testMAC.String()}
+	other := Lease{IP: "192.168.10.105", CHAddr: "52:54:00:ab:cd:ef"}
+	tests := []struct {
+		Name          string
+		Authoritative bool
+		Leases        []Lease
+		CIAddr        net.IP
+		Broadcast     bool
+		Options       []dhcp.Option
+		Expected      dhcp.MessageType // 0 means no reply
+	}{
+		{Name: "selecting", Options: []dhcp.Option{serverID, requestedIP(192, 168, 10, 105)}, Expected: dhcp.ACK},
+		{Name: "selecting-other-server", Options: []dhcp.Option{otherServerID, requestedIP(192, 168, 10, 105)}},
+		{Name: "selecting-without-requested-ip", Options: []dhcp.Option{serverID}},
+		{Name: "selecting-wrong-network", Options: []dhcp.Option{serverID, requestedIP(172, 16, 0, 5)}, Expected: dhcp.NAK},
+		{Name: "selecting-held-by-other", Leases: []Lease{other}, Options: []dhcp.Option{serverID, requestedIP(192, 168, 10, 105)}, Expected: dhcp.NAK},
+		{Name: "init-reboot", Leases: []Lease{own}, Options: []dhcp.Option{requestedIP(192, 168, 10, 105)}, Expected: dhcp.ACK},
+		{Name: "init-reboot-held-by-other", Leases: []Lease{other}, Options: []dhcp.Option{requestedIP(192, 168, 10, 105)}, Expected: dhcp.NAK},
+		{Name: "init-reboot-unknown-client", Options: []dhcp.Option{requestedIP(192, 168, 10, 105)}},
+		{Name: "init-reboot-unknown-client-authoritative", Authoritative: true, Options: []dhcp.Option{requestedIP(192, 168, 10, 105)}, Expected: dhcp.ACK},
+		{Name: "init-reboot-wrong-network", Options: []dhcp.Option{requestedIP(172, 16, 0, 5)}},
+		{Name: "init-reboot-wrong-network-authoritative", Authoritative: true, Options: []dhcp.Option{requestedIP(172, 16, 0, 5)}, Expected: dhcp.NAK},
+		{Name: "renewing", Leases: []Lease{own}, CIAddr: net.IPv4(192, 168, 10, 105).To4(), Expected: dhcp.ACK},
+		{Name: "renewing-unknown-client", CIAddr: net.IPv4(192, 168, 10, 105).To4()},
+		{Name: "rebinding", Leases: []Lease{own}, CIAddr: net.IPv4(192, 168, 10, 105).To4(), Broadcast: true, Expected: dhcp.ACK},
+		{Name: "rebinding-held-by-other", Leases: []Lease{other}, CIAddr: net.IPv4(192, 168, 10, 105).To4(), Broadcast: true, Expected: dhcp.NAK},
+		{Name: "without-requested-ip-or-ciaddr"},
+	}
+	for _, test := range tests {
+		h := newTestHandler(t)
+		h.authoritative = test.Authoritative
+		for _, l := range test.Leases {
+			if _, err := h.leases.Create(l, time.Hour); err != nil {
+				t.Fatalf("%s: Create failed: %v", test.Name, err)
+			}
+		}
+		p := dhcp.RequestPacket(dhcp.Request, testMAC, test.CIAddr, []byte{1, 2, 3, 4}, test.Broadcast, test.Options)
+		res := h.ServeDHCP(p, dhcp.Request, p.ParseOptions())
+		if test.Expected == 0 {
+			if res != nil {
+				t.Errorf("%s: Expected no reply, got %v", test.Name, res.ParseOptions())
+			}
+			continue
+		}
+		if res == nil {
+			t.Errorf("%s: Expected a reply", test.Name)
+			continue
+		}
+		if mt := res.ParseOptions()[dhcp.OptionDHCPMessageType]; len(mt) != 1 || dhcp.MessageType(mt[0]) != test.Expected {
+			t.Errorf("%s: Expected message type %d, got %v", test.Name, test.Expected, mt)
+			continue
+		}
+		if test.Expected == dhcp.ACK {
+			if !res.YIAddr().Equal(net.IPv4(192, 168, 10, 105)) {
+				t.Errorf("%s: Expected yiaddr 192.168.10.105, got %s", test.Name, res.YIAddr())
+			}
+			if l, err := h.leases.GetByIP("192.168.10.105"); err != nil || l.GetState() != LeaseStateBound || l.CHAddr != testMAC.String() {
+				t.Errorf("%s: Expected a bound lease of the client, got %v (%v)", test.Name, l, err)
+			}
+		}
+	}
+}
+
+func TestRequestOtherServerWithdrawsOffer(t *testing.T) {
+	h := newTestHandler(t)
+	offer := serveTestPacket(h, dhcp.Discover, nil, nil)
+	if offer == nil {
+		t.Fatal("Expected an offer")
+	}
+	serveTestPacket(h, dhcp.Request, nil, []dhcp.Option{
+		{Code: dhcp.OptionServerIdentifier, Value: []byte{192, 168, 10, 3}},
+		{Code: dhcp.OptionRequestedIPAddress, Value: []byte{192, 168, 10, 50}},
+	})
+	if _, err := h.leases.GetByIP(offer.YIAddr().String()); !IsLeaseNotFound(err) {
+		t.Errorf("Expected the offer of %s to be withdrawn, got %v", offer.YIAddr(), err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const (
+	// optionClientFQDN is the client FQDN option (RFC 4702).
+	optionClientFQDN dhcp.OptionCode = 81
+
+	// Flags of the client FQDN option
+	fqdnFlagS = 0x01 // Server performs the A record update
+	fqdnFlagO = 0x02 // Server has overridden the S flag of the client
+	fqdnFlagE = 0x04 // Domain name is in canonical wire format
+	fqdnFlagN = 0x08 // Server performs no DNS updates
+
+	// fqdnRCodeResponse is the value of the (deprecated) RCODE fields in responses.
+	fqdnRCodeResponse = 255
+	// maxHostnameLength is the maximum length of a single DNS label.
+	maxHostnameLength = 63
+)
+
+// ClientFQDN is the content of a client FQDN option (81).
+type ClientFQDN struct {
+	Flags byte
+	// Name is the domain name without trailing dot.
+	Name string
+	// Qualified is set when Name is a fully qualified domain name.
+	Qualified bool
+}
+
+// parseClientFQDN returns the client FQDN option (81) found in the given options,
+// or nil if there is no (valid) client FQDN option.
+func parseClientFQDN(options dhcp.Options) *ClientFQDN {
+	data, ok := options[optionClientFQDN]
+	if !ok || len(data) < 3 {
+		return nil
+	}
+	result := &ClientFQDN{Flags: data[0]}
+	name := data[3:]
+	if result.Flags&fqdnFlagE != 0 {
+		// Canonical wire format
+		var labels []string
+		for len(name) > 0 {
+			size := int(name[0])
+			if size == 0 {
+				result.Qualified = true
+				break
+			}
+			if size > maxHostnameLength || len(name) < 1+size || bytes.IndexByte(name[1:1+size], '.') >= 0 {
+				return nil
+			}
+			labels = append(labels, string(name[1:1+size]))
+			name = name[1+size:]
+		}
+		result.Name = strings.Join(labels, ".")
+	} else {
+		// Deprecated ASCII encoding
+		result.Name = strings.TrimSuffix(string(name), ".")
+		result.Qualified = strings.Contains(result.Name, ".")
+	}
+	return result
+}
+
+// Encode returns the value of a client FQDN option with given flags and name,
+// using the same encoding as this option.
+func (f ClientFQDN) Encode(flags byte, name string) []byte {
+	flags |= f.Flags & fqdnFlagE
+	data := []byte{flags, fqdnRCodeResponse, fqdnRCodeResponse}
+	if flags&fqdnFlagE == 0 {
+		return append(data, []byte(name)...)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label != "" {
+			data = append(data, byte(len(label)))
+			data = append(data, []byte(label)...)
+		}
+	}
+	if strings.Contains(name, ".") {
+		// Fully qualified
+		data = append(data, 0)
+	}
+	return data
+}
+
+// Hostname returns the first label of the name.
+func (f ClientFQDN) Hostname() string {
+	return strings.SplitN(f.Name, ".", 2)[0]
+}
+
+// clientHostname returns the hostname the client wants to use, taken from
+// the client FQDN option (81) or the hostname option (12).
+// Returns an empty string if the client did not send a valid hostname.
+func clientHostname(options dhcp.Options) string {
+	var hostname string
+	if fqdn := parseClientFQDN(options); fqdn != nil && fqdn.Name != "" {
+		hostname = fqdn.Hostname()
+	} else if data, ok := options[dhcp.OptionHostName]; ok {
+		hostname = strings.SplitN(string(data), ".", 2)[0]
+	}
+	hostname = strings.ToLower(strings.TrimRight(hostname, "\x00"))
+	if !isValidHostname(hostname) {
+		return ""
+	}
+	return hostname
+}
+
+// isValidHostname returns true if the given hostname is a valid DNS label.
+func isValidHostname(hostname string) bool {
+	if len(hostname) == 0 || len(hostname) > maxHostnameLength {
+		return false
+	}
+	for i, c := range hostname {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' && i > 0 && i < len(hostname)-1:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateHostnameTemplate checks the given hostname template.
+func validateHostnameTemplate(template string) error {
+	if hostname := expandHostnameTemplate(template, net.IPv4(10, 0, 0, 1)); !isValidHostname(hostname) {
+		return maskAny(fmt.Errorf("Hostname-template '%s' does not result in a valid hostname", template))
+	}
+	return nil
+}
+
+// expandHostnameTemplate returns the hostname created from the given template
+// for the given IP address.
+// The template can contain the following placeholders:
+// - {ip-dashes}: the IP address with dashes instead of dots (e.g. 192-168-10-5)
+// - {octet1} ... {octet4}: the individual bytes of the IP address
+func expandHostnameTemplate(template string, ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	replacements := []string{"{ip-dashes}", strings.Replace(ip4.String(), ".", "-", -1)}
+	for i, b := range ip4 {
+		replacements = append(replacements, fmt.Sprintf("{octet%d}", i+1), strconv.Itoa(int(b)))
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
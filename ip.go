@@ -18,3 +18,21 @@ func parseIP(input string) net.IP {
 	}
 	return ip
 }
+
+// broadcastAddress returns the broadcast address of the given IPv4 network.
+func broadcastAddress(n *net.IPNet) net.IP {
+	ip := n.IP.To4()
+	mask := net.IP(n.Mask).To4()
+	result := make(net.IP, len(ip))
+	for i := range ip {
+		result[i] = ip[i] | ^mask[i]
+	}
+	return result
+}
+
+// copyIP returns a copy of the given IP address.
+func copyIP(ip net.IP) net.IP {
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	return result
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/ericchiang/k8s"
+	"github.com/pkg/errors"
+)
+
+// isAPIError returns true if the given error is or is caused by a kubernetes
+// API error with given HTTP status code.
+func isAPIError(err error, code int) bool {
+	if apiErr, ok := errors.Cause(err).(*k8s.APIError); ok {
+		return apiErr.Code == code
+	}
+	return false
+}
+
+// isNotFound returns true if the given error is a kubernetes "not found" error.
+func isNotFound(err error) bool {
+	return isAPIError(err, http.StatusNotFound)
+}
+
+// isConflict returns true if the given error is a kubernetes "conflict" error.
+// This error is returned when an update is made against an outdated resource version,
+// or when creating a resource that already exists.
+func isConflict(err error) bool {
+	return isAPIError(err, http.StatusConflict)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/ericchiang/k8s"
+	corev1 "github.com/ericchiang/k8s/apis/core/v1"
+	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
+)
+
+const (
+	// leaderAnnotation is the annotation of the lock ConfigMap that holds the leader record.
+	leaderAnnotation = "control-plane.alpha.kubernetes.io/leader"
+	// leaderLeaseDuration is the time a leader holds the lock without renewing it.
+	leaderLeaseDuration = 10 * time.Second
+	// leaderRenewDeadline is the time the leader keeps acting as leader when renewing the lock fails.
+	leaderRenewDeadline = 7 * time.Second
+	// leaderRetryPeriod is the interval between attempts to acquire or renew the lock.
+	leaderRetryPeriod = 2 * time.Second
+)
+
+// leaderRecord is the content of the leader annotation.
+type leaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// leaderElector tries to acquire and hold a lock stored as annotation of a ConfigMap.
+type leaderElector struct {
+	client    *k8s.Client
+	name      string
+	namespace string
+	identity  string
+
+	observedRecord string    // Last seen (raw) leader record
+	observedTime   time.Time // Local time at which observedRecord was first seen
+}
+
+// runLeaderElection competes for leadership using a lock stored in a ConfigMap with given name,
+// until the given context is canceled.
+// Whenever leadership is acquired, onStartedLeading is called with a context that is
+// canceled as soon as leadership is lost.
+func runLeaderElection(ctx context.Context, client *k8s.Client, name, namespace, identity string, onStartedLeading func(context.Context)) {
+	e := &leaderElector{
+		client:    client,
+		name:      name,
+		namespace: namespace,
+		identity:  identity,
+	}
+	var stopLeading context.CancelFunc
+	var lastRenew time.Time
+	for {
+		// Every attempt is bounded by the renew deadline, so a hanging API call cannot
+		// keep us acting as leader after another instance may have taken over.
+		start := time.Now()
+		deadline := start.Add(leaderRenewDeadline)
+		var expire *time.Timer
+		if stopLeading != nil {
+			deadline = lastRenew.Add(leaderRenewDeadline)
+			// Stop leading at the deadline, even if the attempt has not returned yet
+			expire = time.AfterFunc(time.Until(deadline), stopLeading)
+		}
+		attemptCtx, cancel := context.WithDeadline(ctx, deadline)
+		isLeader, err := e.tryAcquireOrRenew(attemptCtx)
+		cancel()
+		if expire != nil && !expire.Stop() {
+			// The deadline passed during the attempt, leadership is lost
+			isLeader, err = false, nil
+		}
+		if err != nil {
+			log.Printf("Failed to acquire or renew leadership: %v\n", err)
+			// Remain leader until the renew deadline has passed
+			isLeader = stopLeading != nil && time.Since(lastRenew) < leaderRenewDeadline
+		} else if isLeader {
+			lastRenew = start
+		}
+		if isLeader && stopLeading == nil {
+			log.Printf("Acquired leadership as '%s'\n", identity)
+			var leaderCtx context.Context
+			leaderCtx, stopLeading = context.WithCancel(ctx)
+			go onStartedLeading(leaderCtx)
+		} else if !isLeader && stopLeading != nil {
+			log.Printf("Lost leadership as '%s'\n", identity)
+			stopLeading()
+			stopLeading = nil
+		}
+
+		select {
+		case <-time.After(leaderRetryPeriod):
+			// Continue
+		case <-ctx.Done():
+			if stopLeading != nil {
+				stopLeading()
+			}
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew tries to acquire the lock, or renew it when it is already held by us.
+// Returns true if we are the leader, false otherwise.
+func (e *leaderElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now()
+	record := leaderRecord{
+		HolderIdentity:       e.identity,
+		LeaseDurationSeconds: int(leaderLeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := e.client.Get(ctx, e.namespace, e.name, cm); isNotFound(err) {
+		// Lock does not exist yet, create it
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return false, maskAny(err)
+		}
+		cm = &corev1.ConfigMap{
+			Metadata: &metav1.ObjectMeta{
+				Name:        k8s.String(e.name),
+				Namespace:   k8s.String(e.namespace),
+				Annotations: map[string]string{leaderAnnotation: string(encoded)},
+			},
+		}
+		if err := e.client.Create(ctx, cm); isConflict(err) {
+			// Someone else was faster
+			return false, nil
+		} else if err != nil {
+			return false, maskAny(err)
+		}
+		e.observedRecord = string(encoded)
+		e.observedTime = now
+		return true, nil
+	} else if err != nil {
+		return false, maskAny(err)
+	}
+
+	// Inspect the current leader
+	raw := cm.GetMetadata().GetAnnotations()[leaderAnnotation]
+	if raw != e.observedRecord {
+		e.observedRecord = raw
+		e.observedTime = now
+	}
+	var current leaderRecord
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &current); err != nil {
+			log.Printf("Failed to parse leader record: %v\n", err)
+		}
+	}
+	if current.HolderIdentity != "" && current.HolderIdentity != e.identity {
+		// Lock is held by someone else, check if it has expired.
+		// Expiration is based on the local time at which the record last changed,
+		// to avoid problems with clock skew.
+		duration := time.Duration(current.LeaseDurationSeconds) * time.Second
+		if e.observedTime.Add(duration).After(now) {
+			return false, nil
+		}
+		log.Printf("Leadership of '%s' has expired\n", current.HolderIdentity)
+	} else if current.HolderIdentity == e.identity {
+		// We already hold the lock, keep the acquire time
+		record.AcquireTime = current.AcquireTime
+	}
+
+	// Update the lock, using the resource version we just read
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	meta := cm.GetMetadata()
+	if meta.Annotations == nil {
+		meta.Annotations = make(map[string]string)
+	}
+	meta.Annotations[leaderAnnotation] = string(encoded)
+	if err := e.client.Update(ctx, cm); isConflict(err) {
+		// Someone else modified the lock
+		return false, nil
+	} else if err != nil {
+		return false, maskAny(err)
+	}
+	e.observedRecord = string(encoded)
+	e.observedTime = now
+	return true, nil
+}
+
+// reloadableLeaseRegistry is implemented by lease registries that cache leases.
+type reloadableLeaseRegistry interface {
+	// Reload discards all cached leases and loads the current leases.
+	Reload() error
+}
+
+// reloadLeases reloads the given registry if it caches leases, retrying until
+// it succeeds or the given context is canceled.
+// This is used by a new leader, so it does not serve requests based on leases
+// that are older than the last modifications of the previous leader.
+// Returns false if the context is canceled.
+func reloadLeases(ctx context.Context, leases LeaseRegistry) bool {
+	r, ok := leases.(reloadableLeaseRegistry)
+	if !ok {
+		return true
+	}
+	for {
+		err := r.Reload()
+		if err == nil {
+			return true
+		}
+		log.Printf("Failed to reload leases: %v\n", err)
+		select {
+		case <-time.After(leaderRetryPeriod):
+			// Try again
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
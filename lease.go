@@ -10,6 +10,9 @@ import (
 var (
 	// LeaseNotFoundError is the error that is returned when a lease cannot be found.
 	LeaseNotFoundError = errors.New("lease not found")
+	// LeaseConflictError is the error that is returned when a lease cannot be stored
+	// because its IP is held by another client.
+	LeaseConflictError = errors.New("lease held by another client")
 )
 
 // IsLeaseNotFound returns true if the given error is or is caused by a LeaseNotFoundError.
@@ -17,11 +20,43 @@ func IsLeaseNotFound(err error) bool {
 	return errors.Cause(err) == LeaseNotFoundError
 }
 
+// IsLeaseConflict returns true if the given error is or is caused by a LeaseConflictError.
+func IsLeaseConflict(err error) bool {
+	return errors.Cause(err) == LeaseConflictError
+}
+
+// LeaseState is the state of a lease
+type LeaseState string
+
+const (
+	// LeaseStateOffered is the state of an address that is offered to a client.
+	// It is held for that client until the client requests it or the offer expires.
+	LeaseStateOffered LeaseState = "offered"
+	// LeaseStateBound is the state of an address that is assigned to a client.
+	LeaseStateBound LeaseState = "bound"
+	// LeaseStateQuarantined is the state of an address that is found to be in use
+	// by an unknown host. It is not assigned to any client until the lease expires.
+	LeaseStateQuarantined LeaseState = "quarantined"
+)
+
 // Lease is a single IP address claim
 type Lease struct {
-	IP          string      `json:"ip"`         // Leased IP address
-	CHAddr      string      `json:"chaddr"`     // Client's hardware address
-	ExpiratesAt metav1.Time `json:"expires-at"` // When the lease expires
+	IP          string      `json:"ip"`                  // Leased IP address
+	CHAddr      string      `json:"chaddr"`              // Client's hardware address
+	ClientID    string      `json:"client-id,omitempty"` // Client identifier (option 61) as colon separated hex bytes
+	Hostname    string      `json:"hostname,omitempty"`  // Hostname of the client (option 12 or 81)
+	FQDN        string      `json:"fqdn,omitempty"`      // Fully qualified domain name of the client
+	State       LeaseState  `json:"state,omitempty"`     // State of the lease
+	ExpiratesAt metav1.Time `json:"expires-at"`          // When the lease expires
+}
+
+// GetState returns the state of the lease.
+// Leases without a state are bound.
+func (l Lease) GetState() LeaseState {
+	if l.State == "" {
+		return LeaseStateBound
+	}
+	return l.State
 }
 
 // GetExpiresAt returns the expiration time of the lease
@@ -31,20 +66,89 @@ func (l Lease) GetExpiresAt() time.Time {
 	return time.Unix(seconds, nanos)
 }
 
+// newTime converts the given time into a metav1.Time.
+func newTime(t time.Time) metav1.Time {
+	seconds := t.Unix()
+	nanos := int32(t.Nanosecond())
+	return metav1.Time{
+		Seconds: &seconds,
+		Nanos:   &nanos,
+	}
+}
+
 // IsExpired returns true when the lease is expired,
 // false otherwise.
 func (l Lease) IsExpired() bool {
 	return l.GetExpiresAt().Before(time.Now())
 }
 
+// canReplace returns true if the given current lease of an IP can be replaced or removed
+// on behalf of the given lease. This is the case when the current lease is expired,
+// belongs to the same client, or when the given lease quarantines the address.
+func canReplace(current, l Lease) bool {
+	if current.IsExpired() || l.GetState() == LeaseStateQuarantined {
+		return true
+	}
+	if current.ClientID != "" && current.ClientID == l.ClientID {
+		return true
+	}
+	return current.CHAddr == l.CHAddr && (current.CHAddr != "" || current.ClientID == l.ClientID)
+}
+
+// ClientMatch is the strategy used to decide to which client a lease belongs.
+type ClientMatch string
+
+const (
+	// ClientMatchClientID identifies a client by its client identifier (option 61),
+	// or by its hardware address if it does not send a client identifier (RFC 2131 section 4.2).
+	ClientMatchClientID ClientMatch = "client-id"
+	// ClientMatchMAC identifies a client by its hardware address only.
+	ClientMatchMAC ClientMatch = "mac"
+	// ClientMatchBoth identifies a client by both its client identifier and its hardware address.
+	ClientMatchBoth ClientMatch = "both"
+)
+
+// IsValid returns true if the given strategy is known.
+func (m ClientMatch) IsValid() bool {
+	switch m {
+	case ClientMatchClientID, ClientMatchMAC, ClientMatchBoth:
+		return true
+	}
+	return false
+}
+
+// Owns returns true if the given lease belongs to the client with given
+// hardware address and client identifier (empty if the client did not send one).
+func (m ClientMatch) Owns(l Lease, chAddr, clientID string) bool {
+	switch m {
+	case ClientMatchMAC:
+		return l.CHAddr == chAddr
+	case ClientMatchBoth:
+		return l.CHAddr == chAddr && l.ClientID == clientID
+	default:
+		if clientID != "" {
+			return l.ClientID == clientID
+		}
+		return l.ClientID == "" && l.CHAddr == chAddr
+	}
+}
+
 // LeaseRegistry abstracts a registry of leases.
 type LeaseRegistry interface {
+	// Get all leases
+	List() ([]Lease, error)
 	// Get the lease for the given IP
 	GetByIP(ip string) (*Lease, error)
 	// Get all leases for the given hardware address
 	ListByCHAddr(chAddr string) ([]Lease, error)
-	// Remove the given lease
+	// Get all leases for the given client identifier
+	ListByClientID(clientID string) ([]Lease, error)
+	// Get all leases for the given fully qualified domain name
+	ListByFQDN(fqdn string) ([]Lease, error)
+	// Remove the given lease.
+	// Returns a LeaseConflictError if the IP holds an unexpired lease of another client.
 	Remove(l *Lease) error
-	// Create a lease with given IP, hardware address and time to live.
-	Create(ip string, chAddr string, ttl time.Duration) (*Lease, error)
+	// Create or replace the lease for the IP of the given lease, expiring after the given time to live.
+	// Returns a LeaseConflictError if the IP holds an unexpired lease of another client.
+	Create(l Lease, ttl time.Duration) (*Lease, error)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const (
+	// defaultLeaseTime is the lease time used when none is configured.
+	defaultLeaseTime = 2 * time.Hour
+	// maxLeaseSeconds is the largest lease time that fits in the lease time option (51).
+	// The value 0xffffffff means infinity and is never given out.
+	maxLeaseSeconds = 0xfffffffe
+)
+
+// LeaseTimes holds the lease times given to clients.
+// Unset times are inherited from the enclosing scope (global, subnet, range).
+type LeaseTimes struct {
+	LeaseTime    string `json:"lease-time,omitempty"`     // Lease time given when the client does not request one (e.g. "2h")
+	MinLeaseTime string `json:"min-lease-time,omitempty"` // Minimum lease time a client can request
+	MaxLeaseTime string `json:"max-lease-time,omitempty"` // Maximum lease time a client can request, defaults to the lease time
+	// RenewalTime is the time after which the client starts renewing its lease (T1, option 58).
+	// Defaults to 50% of the lease time.
+	RenewalTime string `json:"renewal-time,omitempty"`
+	// RebindingTime is the time after which the client starts rebinding its lease (T2, option 59).
+	// Defaults to 87.5% of the lease time.
+	RebindingTime string `json:"rebinding-time,omitempty"`
+}
+
+// Validate checks the values in the given lease times.
+// Returns nil if all ok, otherwise an error.
+func (t LeaseTimes) Validate() error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"lease-time", t.LeaseTime},
+		{"min-lease-time", t.MinLeaseTime},
+		{"max-lease-time", t.MaxLeaseTime},
+		{"renewal-time", t.RenewalTime},
+		{"rebinding-time", t.RebindingTime},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(f.value)
+		if err != nil || d < time.Second {
+			return maskAny(fmt.Errorf("Failed to parse %s '%s'", f.name, f.value))
+		}
+		if d/time.Second > maxLeaseSeconds {
+			return maskAny(fmt.Errorf("%s '%s' is too long", f.name, f.value))
+		}
+	}
+	if t.MinLeaseTime != "" && t.MaxLeaseTime != "" && t.getMinLeaseTime() > t.getMaxLeaseTime() {
+		return maskAny(fmt.Errorf("Min-lease-time '%s' is larger than max-lease-time '%s'", t.MinLeaseTime, t.MaxLeaseTime))
+	}
+	if t.LeaseTime != "" && t.MaxLeaseTime != "" && parseDurationOr(t.LeaseTime, 0) > t.getMaxLeaseTime() {
+		return maskAny(fmt.Errorf("Lease-time '%s' is larger than max-lease-time '%s'", t.LeaseTime, t.MaxLeaseTime))
+	}
+	if t.RenewalTime != "" && t.RebindingTime != "" && parseDurationOr(t.RenewalTime, 0) >= parseDurationOr(t.RebindingTime, 0) {
+		return maskAny(fmt.Errorf("Renewal-time '%s' must be smaller than rebinding-time '%s'", t.RenewalTime, t.RebindingTime))
+	}
+	return nil
+}
+
+// ValidateEffective checks that the lease times, including the defaults of unset times,
+// are consistent. Use it on lease times merged with those of all enclosing scopes.
+// Returns nil if all ok, otherwise an error.
+func (t LeaseTimes) ValidateEffective() error {
+	leaseTime := parseDurationOr(t.LeaseTime, defaultLeaseTime)
+	min, max := t.getMinLeaseTime(), t.getMaxLeaseTime()
+	if min > max {
+		return maskAny(fmt.Errorf("Min-lease-time %s is larger than max-lease-time %s", min, max))
+	}
+	if leaseTime > max {
+		return maskAny(fmt.Errorf("Lease-time %s is larger than max-lease-time %s", leaseTime, max))
+	}
+	if leaseTime < min {
+		return maskAny(fmt.Errorf("Lease-time %s is smaller than min-lease-time %s", leaseTime, min))
+	}
+	if t.RenewalTime != "" && t.RebindingTime != "" && parseDurationOr(t.RenewalTime, 0) >= parseDurationOr(t.RebindingTime, 0) {
+		return maskAny(fmt.Errorf("Renewal-time '%s' must be smaller than rebinding-time '%s'", t.RenewalTime, t.RebindingTime))
+	}
+	return nil
+}
+
+// Merge returns a copy of the lease times, with all fields that are set
+// in the given override replaced.
+func (t LeaseTimes) Merge(override LeaseTimes) LeaseTimes {
+	if override.LeaseTime != "" {
+		t.LeaseTime = override.LeaseTime
+	}
+	if override.MinLeaseTime != "" {
+		t.MinLeaseTime = override.MinLeaseTime
+	}
+	if override.MaxLeaseTime != "" {
+		t.MaxLeaseTime = override.MaxLeaseTime
+	}
+	if override.RenewalTime != "" {
+		t.RenewalTime = override.RenewalTime
+	}
+	if override.RebindingTime != "" {
+		t.RebindingTime = override.RebindingTime
+	}
+	return t
+}
+
+// GetLeaseTime returns the lease time for a client that requested the given lease time
+// (option 51). A requested lease time of 0 means that the client has no preference,
+// in that case the configured lease time is used.
+// The lease time is bounded by the minimum and maximum lease time.
+func (t LeaseTimes) GetLeaseTime(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		requested = parseDurationOr(t.LeaseTime, defaultLeaseTime)
+	}
+	if min := t.getMinLeaseTime(); requested < min {
+		requested = min
+	}
+	if max := t.getMaxLeaseTime(); requested > max {
+		requested = max
+	}
+	return requested
+}
+
+// GetTimers returns the renewal (T1) and rebinding (T2) times for the given lease time.
+// Configured times that do not fit in the lease time are replaced by their defaults.
+func (t LeaseTimes) GetTimers(leaseTime time.Duration) (time.Duration, time.Duration) {
+	t1 := parseDurationOr(t.RenewalTime, leaseTime/2)
+	t2 := parseDurationOr(t.RebindingTime, leaseTime*7/8)
+	if t2 >= leaseTime {
+		t2 = leaseTime * 7 / 8
+	}
+	if t1 >= t2 {
+		t1 = leaseTime / 2
+		if t1 >= t2 {
+			t1 = t2 / 2
+		}
+	}
+	return t1, t2
+}
+
+// getMinLeaseTime returns the minimum lease time a client can request.
+func (t LeaseTimes) getMinLeaseTime() time.Duration {
+	return parseDurationOr(t.MinLeaseTime, time.Second)
+}
+
+// getMaxLeaseTime returns the maximum lease time a client can request.
+func (t LeaseTimes) getMaxLeaseTime() time.Duration {
+	return parseDurationOr(t.MaxLeaseTime, parseDurationOr(t.LeaseTime, defaultLeaseTime))
+}
+
+// requestedLeaseTime returns the lease time requested by the client (option 51),
+// or 0 if the client did not request a lease time.
+func requestedLeaseTime(options dhcp.Options) time.Duration {
+	data, ok := options[dhcp.OptionIPAddressLeaseTime]
+	if !ok || len(data) != 4 {
+		return 0
+	}
+	seconds := binary.BigEndian.Uint32(data)
+	if seconds > maxLeaseSeconds {
+		seconds = maxLeaseSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// timerOptions returns the renewal (58) and rebinding (59) time options.
+func timerOptions(t1, t2 time.Duration) []dhcp.Option {
+	return []dhcp.Option{
+		{Code: dhcp.OptionRenewalTimeValue, Value: dhcp.OptionsLeaseTime(t1)},
+		{Code: dhcp.OptionRebindingTimeValue, Value: dhcp.OptionsLeaseTime(t2)},
+	}
+}
+
+// parseDurationOr returns the parsed duration, or the given default when
+// the duration is not set or invalid.
+func parseDurationOr(value string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	return defaultValue
+}
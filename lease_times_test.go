@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetLeaseTimeBounds(t *testing.T) {
+	times := LeaseTimes{MaxLeaseTime: "1h"}.Merge(LeaseTimes{LeaseTime: "2h"})
+	if d := times.GetLeaseTime(0); d != time.Hour {
+		t.Errorf("Expected default lease time clamped to 1h, got %s", d)
+	}
+	times = LeaseTimes{LeaseTime: "1h", MaxLeaseTime: "4h"}.Merge(LeaseTimes{MinLeaseTime: "90m"})
+	if d := times.GetLeaseTime(0); d != 90*time.Minute {
+		t.Errorf("Expected default lease time raised to 90m, got %s", d)
+	}
+	times = LeaseTimes{LeaseTime: "1h", MinLeaseTime: "10m", MaxLeaseTime: "4h"}
+	for requested, expected := range map[time.Duration]time.Duration{
+		0:                time.Hour,
+		time.Minute:      10 * time.Minute,
+		2 * time.Hour:    2 * time.Hour,
+		24 * time.Hour:   4 * time.Hour,
+		10 * time.Minute: 10 * time.Minute,
+	} {
+		if d := times.GetLeaseTime(requested); d != expected {
+			t.Errorf("Requested %s: expected %s, got %s", requested, expected, d)
+		}
+	}
+}
+
+func TestValidateMergedLeaseTimes(t *testing.T) {
+	config := DHCPConfig{
+		ServerIP: "192.168.10.2",
+		SubnetConfig: SubnetConfig{
+			Subnet:     "192.168.10.0/24",
+			Ranges:     []AddressRange{{Start: "192.168.10.100", Length: 10, LeaseTimes: LeaseTimes{LeaseTime: "2h"}}},
+			LeaseTimes: LeaseTimes{MaxLeaseTime: "1h"},
+		},
+	}
+	if err := config.Validate(""); err == nil {
+		t.Error("Expected range lease-time above the global max-lease-time to be rejected")
+	}
+}
+
+func TestValidateInheritedLeaseTimes(t *testing.T) {
+	config := DHCPConfig{
+		ServerIP: "192.168.10.2",
+		SubnetConfig: SubnetConfig{
+			Subnet:     "192.168.10.0/24",
+			Ranges:     []AddressRange{{Start: "192.168.10.100", Length: 10, LeaseTimes: LeaseTimes{MaxLeaseTime: "1h"}}},
+			LeaseTimes: LeaseTimes{LeaseTime: "30m"},
+		},
+	}
+	if err := config.Validate(""); err != nil {
+		t.Errorf("Expected range max-lease-time above the global lease-time to be accepted: %v", err)
+	}
+}
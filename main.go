@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 
 	"github.com/ericchiang/k8s"
@@ -13,15 +14,27 @@ import (
 var (
 	maskAny = errors.WithStack
 	options struct {
-		configMapName string
+		configMapName      string
+		leaseRegistry      string
+		leaseConfigMapName string
+		leaderElection     bool
+		leaderElectionLock string
+		metricsAddress     string
 	}
 )
 
 func init() {
 	pflag.StringVar(&options.configMapName, "config-map", "kube-dhcp-config", "Name of ConfigMap in current namespace containing the DHCP configuration")
+	pflag.StringVar(&options.leaseRegistry, "lease-registry", "configmap", "Type of registry used to store leases (configmap|crd|memory)")
+	pflag.StringVar(&options.leaseConfigMapName, "lease-config-map", "kube-dhcp-leases", "Name of ConfigMap in current namespace used to store leases")
+	pflag.BoolVar(&options.leaderElection, "leader-election", false, "If set, only the elected leader serves DHCP requests")
+	pflag.StringVar(&options.metricsAddress, "metrics-address", ":9067", "Address on which metrics are served (empty to disable)")
+	pflag.StringVar(&options.leaderElectionLock, "leader-election-lock", "kube-dhcp-leader", "Name of ConfigMap in current namespace used as leader election lock")
 }
 
 func main() {
+	pflag.Parse()
+
 	// Check options & env
 	namespace := os.Getenv("METADATA_NAMESPACE")
 	if namespace == "" {
@@ -36,33 +49,78 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Create lease registry
+	var leases LeaseRegistry
+	switch options.leaseRegistry {
+	case "configmap":
+		leases = NewConfigMapLeaseRegistry(client, options.leaseConfigMapName, namespace)
+	case "crd":
+		leases = NewCRDLeaseRegistry(client, namespace)
+	case "memory":
+		leases = NewMemoryLeaseRegistry()
+	default:
+		log.Fatalf("Unknown lease registry '%s'\n", options.leaseRegistry)
+	}
+
+	// Serve metrics
+	if options.metricsAddress != "" {
+		go func() {
+			if err := http.ListenAndServe(options.metricsAddress, nil); err != nil {
+				log.Printf("Failed to serve metrics: %v\n", err)
+			}
+		}()
+	}
 
-	// Watch for config changes, relaunch handler on a valid change.
+	// Start listening for DHCP requests.
+	// The listener is kept open for the lifetime of the process,
+	// or as long as we're the leader when leader election is enabled.
 	ctx := context.Background()
+	server := NewServer()
+	runServer := func(ctx context.Context) {
+		if err := server.Run(ctx); err != nil {
+			log.Fatalf("Run failed: %v\n", err)
+		}
+	}
+	if options.leaderElection {
+		if options.leaseRegistry == "memory" {
+			log.Fatal("Leader election requires a persistent lease registry\n")
+		}
+		identity := os.Getenv("METADATA_NAME")
+		if identity == "" {
+			if identity, err = os.Hostname(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		go runLeaderElection(ctx, client, options.leaderElectionLock, namespace, identity, func(ctx context.Context) {
+			if reloadLeases(ctx, leases) {
+				runServer(ctx)
+			}
+		})
+	} else {
+		go runServer(ctx)
+	}
+
+	// Watch for config changes, replace handler on a valid change.
 	configChan := make(chan DHCPConfig)
 	go watchForConfigChanges(ctx, client, options.configMapName, namespace, nodeIP, configChan)
 
-	var stopFunc context.CancelFunc
 	for {
 		select {
 		case config := <-configChan:
+			// Create DNS updater
+			dns, err := NewDNSUpdater(config.DNSUpdate, client, namespace)
+			if err != nil {
+				log.Printf("Creating DNS updater failed, keeping current handler: %s\n", err)
+				continue
+			}
 			// Create handler
-			handler, err := NewHandler(config)
+			handler, err := NewHandler(config, leases, dns)
 			if err != nil {
 				log.Fatalf("Creating handler failed: %s\n", err)
 			}
-			// Stop current handler
-			if stopFunc != nil {
-				stopFunc()
-			}
-			// Prepare context for new handler
-			handlerCtx, cancel := context.WithCancel(ctx)
-			go func() {
-				if err := handler.Run(handlerCtx); err != nil {
-					log.Printf("Run failed: %v\n", err)
-				}
-			}()
-			stopFunc = cancel
+			// Replace current handler
+			server.SetHandler(handler)
+			handler.ReportLeasesOutOfRange()
 			log.Printf("Launched updated handler on %s\n", config.ServerIP)
 		}
 	}
@@ -1,10 +1,9 @@
 package main
 
 import (
+	"strings"
 	"sync"
 	"time"
-
-	metav1 "github.com/ericchiang/k8s/apis/meta/v1"
 )
 
 type memoryLeaseRegistry struct {
@@ -19,6 +18,18 @@ func NewMemoryLeaseRegistry() LeaseRegistry {
 	}
 }
 
+// Get all leases
+func (r *memoryLeaseRegistry) List() ([]Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := make([]Lease, 0, len(r.leases))
+	for _, l := range r.leases {
+		result = append(result, l)
+	}
+	return result, nil
+}
+
 // Get the lease for the given IP
 func (r *memoryLeaseRegistry) GetByIP(ip string) (*Lease, error) {
 	r.mutex.Lock()
@@ -45,32 +56,57 @@ func (r *memoryLeaseRegistry) ListByCHAddr(chAddr string) ([]Lease, error) {
 	return result, nil
 }
 
-// Remove the given lease
+// Get all the leases for the given client identifier
+func (r *memoryLeaseRegistry) ListByClientID(clientID string) ([]Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var result []Lease
+	for _, l := range r.leases {
+		if l.ClientID == clientID {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// Get all the leases for the given fully qualified domain name
+func (r *memoryLeaseRegistry) ListByFQDN(fqdn string) ([]Lease, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var result []Lease
+	for _, l := range r.leases {
+		if strings.EqualFold(l.FQDN, fqdn) {
+			result = append(result, l)
+		}
+	}
+	return result, nil
+}
+
+// Remove the given lease, unless the IP now holds an unexpired lease of another client.
 func (r *memoryLeaseRegistry) Remove(l *Lease) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	if current, found := r.leases[l.IP]; found && !canReplace(current, *l) {
+		return maskAny(LeaseConflictError)
+	}
 	delete(r.leases, l.IP)
 	return nil
 }
 
-// Create a lease with given IP, hardware address and time to live.
-func (r *memoryLeaseRegistry) Create(ip string, chAddr string, ttl time.Duration) (*Lease, error) {
-	t := time.Now().Add(ttl)
-	seconds := t.Unix()
-	nanos := int32(t.UnixNano())
-	l := Lease{
-		IP:     ip,
-		CHAddr: chAddr,
-		ExpiratesAt: metav1.Time{
-			Seconds: &seconds,
-			Nanos:   &nanos,
-		},
-	}
+// Create stores the given lease, expiring after the given time to live,
+// unless the IP holds an unexpired lease of another client.
+func (r *memoryLeaseRegistry) Create(l Lease, ttl time.Duration) (*Lease, error) {
+	l.ExpiratesAt = newTime(time.Now().Add(ttl))
 
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	r.leases[ip] = l
+	if current, found := r.leases[l.IP]; found && !canReplace(current, l) {
+		return nil, maskAny(LeaseConflictError)
+	}
+	r.leases[l.IP] = l
 	return &l, nil
 }
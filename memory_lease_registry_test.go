@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryLeaseRegistryConflicts(t *testing.T) {
+	r := NewMemoryLeaseRegistry()
+	if _, err := r.Create(Lease{IP: "10.0.0.5", CHAddr: "52:54:00:00:00:01"}, time.Hour); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	other := Lease{IP: "10.0.0.5", CHAddr: "52:54:00:00:00:02"}
+	if _, err := r.Create(other, time.Hour); !IsLeaseConflict(err) {
+		t.Errorf("Expected a conflict creating a lease held by another client, got %v", err)
+	}
+	if err := r.Remove(&other); !IsLeaseConflict(err) {
+		t.Errorf("Expected a conflict removing a lease held by another client, got %v", err)
+	}
+	// The same client can renew, and anyone can quarantine
+	if _, err := r.Create(Lease{IP: "10.0.0.5", CHAddr: "52:54:00:00:00:01"}, time.Hour); err != nil {
+		t.Errorf("Expected renewal to succeed, got %v", err)
+	}
+	if _, err := r.Create(Lease{IP: "10.0.0.5", State: LeaseStateQuarantined}, time.Hour); err != nil {
+		t.Errorf("Expected quarantine to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"expvar"
+)
+
+// Metrics are exposed in JSON format on /debug/vars of the metrics address.
+var (
+	// declinedAddresses counts the addresses that are quarantined because a client declined them.
+	declinedAddresses = expvar.NewInt("declined_addresses")
+	// conflictingAddresses counts the addresses that are quarantined because they responded to a probe.
+	conflictingAddresses = expvar.NewInt("conflicting_addresses")
+	// dnsUpdateFailures counts the failed attempts to add or remove DNS records of leased hosts.
+	dnsUpdateFailures = expvar.NewInt("dns_update_failures")
+	// deniedClients counts the discovers and requests of clients that are denied by the access policy.
+	deniedClients = expvar.NewInt("denied_clients")
+)
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Types of custom option values
+const (
+	optionTypeIP     = "ip"      // Single IPv4 address
+	optionTypeIPList = "ip-list" // List of IPv4 addresses
+	optionTypeUint8  = "uint8"
+	optionTypeUint16 = "uint16"
+	optionTypeUint32 = "uint32"
+	optionTypeBool   = "bool"
+	optionTypeString = "string"
+	optionTypeHex    = "hex"    // Raw bytes, as (colon separated) hex bytes
+	optionTypeRoutes = "routes" // Classless static routes (RFC 3442)
+	// List of domain names, compressed as described in RFC 1035 section 4.1.4
+	optionTypeDomainList = "domain-list"
+)
+
+const (
+	// optionClasslessStaticRoute is the classless static route option (RFC 3442).
+	optionClasslessStaticRoute dhcp.OptionCode = 121
+	// optionMSClasslessStaticRoute is the Microsoft variant of the classless static route option.
+	optionMSClasslessStaticRoute dhcp.OptionCode = 249
+	// maxOptionLength is the maximum length of the value of a single option instance.
+	maxOptionLength = 255
+)
+
+// wellKnownOption is an option that can be referred to by name.
+type wellKnownOption struct {
+	Code dhcp.OptionCode
+	Type string
+}
+
+// wellKnownOptions contains the options that can be referred to by name.
+var wellKnownOptions = map[string]wellKnownOption{
+	"subnet-mask":                {dhcp.OptionSubnetMask, optionTypeIP},
+	"time-offset":                {dhcp.OptionTimeOffset, optionTypeUint32},
+	"routers":                    {dhcp.OptionRouter, optionTypeIPList},
+	"time-servers":               {dhcp.OptionTimeServer, optionTypeIPList},
+	"dns-servers":                {dhcp.OptionDomainNameServer, optionTypeIPList},
+	"log-servers":                {dhcp.OptionLogServer, optionTypeIPList},
+	"host-name":                  {dhcp.OptionHostName, optionTypeString},
+	"domain-name":                {dhcp.OptionDomainName, optionTypeString},
+	"root-path":                  {dhcp.OptionRootPath, optionTypeString},
+	"ip-forwarding":              {dhcp.OptionIPForwardingEnableDisable, optionTypeBool},
+	"default-ip-ttl":             {dhcp.OptionDefaultIPTimeToLive, optionTypeUint8},
+	"interface-mtu":              {dhcp.OptionInterfaceMTU, optionTypeUint16},
+	"broadcast-address":          {dhcp.OptionBroadcastAddress, optionTypeIP},
+	"arp-cache-timeout":          {dhcp.OptionARPCacheTimeout, optionTypeUint32},
+	"tcp-default-ttl":            {dhcp.OptionTCPDefaultTTL, optionTypeUint8},
+	"nis-domain":                 {dhcp.OptionNetworkInformationServiceDomain, optionTypeString},
+	"nis-servers":                {dhcp.OptionNetworkInformationServers, optionTypeIPList},
+	"ntp-servers":                {dhcp.OptionNetworkTimeProtocolServers, optionTypeIPList},
+	"vendor-specific":            {dhcp.OptionVendorSpecificInformation, optionTypeHex},
+	"netbios-name-servers":       {dhcp.OptionNetBIOSOverTCPIPNameServer, optionTypeIPList},
+	"netbios-node-type":          {dhcp.OptionNetBIOSOverTCPIPNodeType, optionTypeUint8},
+	"domain-search":              {dhcp.OptionDomainSearch, optionTypeDomainList},
+	"tftp-server-name":           {dhcp.OptionTFTPServerName, optionTypeString},
+	"bootfile-name":              {dhcp.OptionBootFileName, optionTypeString},
+	"classless-static-routes":    {optionClasslessStaticRoute, optionTypeRoutes},
+	"ms-classless-static-routes": {optionMSClasslessStaticRoute, optionTypeRoutes},
+	"wpad-url":                   {252, optionTypeString},
+}
+
+// reservedOptions contains the options that are managed by the server itself
+// and cannot be configured.
+var reservedOptions = map[dhcp.OptionCode]struct{}{
+	dhcp.Pad:                          {},
+	dhcp.OptionRequestedIPAddress:     {},
+	dhcp.OptionIPAddressLeaseTime:     {},
+	dhcp.OptionOverload:               {},
+	dhcp.OptionDHCPMessageType:        {},
+	dhcp.OptionServerIdentifier:       {},
+	dhcp.OptionParameterRequestList:   {},
+	dhcp.OptionMaximumDHCPMessageSize: {},
+	dhcp.OptionRenewalTimeValue:       {},
+	dhcp.OptionRebindingTimeValue:     {},
+	dhcp.OptionClientIdentifier:       {},
+	optionClientFQDN:                  {},
+	dhcp.OptionRelayAgentInformation:  {},
+	dhcp.End:                          {},
+}
+
+// CustomOption is a DHCP option with a typed value.
+// The option is specified by its code or by a well-known name.
+type CustomOption struct {
+	Code int    `json:"code,omitempty"` // Option code
+	Name string `json:"name,omitempty"` // Well-known name of the option (e.g. "ntp-servers")
+	// Type of the value: ip, ip-list, uint8, uint16, uint32, bool, string, hex, routes or domain-list.
+	// Defaults to the type of a well-known option.
+	Type  string          `json:"type,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Validate changes the values in the given option.
+// Returns nil if all ok, otherwise an error.
+func (o *CustomOption) Validate() error {
+	if o.Name != "" {
+		known, found := wellKnownOptions[o.Name]
+		if !found {
+			return maskAny(fmt.Errorf("Unknown option name '%s'", o.Name))
+		}
+		if o.Code != 0 && o.Code != int(known.Code) {
+			return maskAny(fmt.Errorf("Option '%s' has code %d, got %d", o.Name, known.Code, o.Code))
+		}
+		o.Code = int(known.Code)
+		if o.Type == "" {
+			o.Type = known.Type
+		}
+	}
+	if o.Code <= 0 || o.Code >= 255 {
+		return maskAny(fmt.Errorf("Option code must be between 1 and 254, got %d", o.Code))
+	}
+	if _, found := reservedOptions[dhcp.OptionCode(o.Code)]; found {
+		return maskAny(fmt.Errorf("Option %d is managed by the server and cannot be configured", o.Code))
+	}
+	if o.Type == "" {
+		return maskAny(fmt.Errorf("Option %d must have a type", o.Code))
+	}
+	if _, err := o.Encode(); err != nil {
+		return maskAny(fmt.Errorf("Invalid value for option %d: %v", o.Code, err))
+	}
+	return nil
+}
+
+// Encode returns the value of the option in wire format.
+func (o CustomOption) Encode() ([]byte, error) {
+	switch o.Type {
+	case optionTypeIP:
+		var value string
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, maskAny(err)
+		}
+		return encodeIPs([]string{value})
+	case optionTypeIPList:
+		values, err := unmarshalStringList(o.Value)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return encodeIPs(values)
+	case optionTypeUint8, optionTypeUint16, optionTypeUint32:
+		var value uint64
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, maskAny(err)
+		}
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, value)
+		size := map[string]int{optionTypeUint8: 1, optionTypeUint16: 2, optionTypeUint32: 4}[o.Type]
+		if value>>uint(8*size) != 0 {
+			return nil, maskAny(fmt.Errorf("Value %d does not fit in %s", value, o.Type))
+		}
+		return data[8-size:], nil
+	case optionTypeBool:
+		var value bool
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, maskAny(err)
+		}
+		if value {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case optionTypeString:
+		var value string
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, maskAny(err)
+		}
+		if value == "" {
+			return nil, maskAny(fmt.Errorf("Empty string"))
+		}
+		return []byte(value), nil
+	case optionTypeHex:
+		var value string
+		if err := json.Unmarshal(o.Value, &value); err != nil {
+			return nil, maskAny(err)
+		}
+		if !strings.Contains(value, ":") {
+			// Allow hex bytes without separators
+			if len(value)%2 != 0 {
+				return nil, maskAny(fmt.Errorf("Hex value '%s' has an odd number of digits", value))
+			}
+			var parts []string
+			for i := 0; i < len(value); i += 2 {
+				parts = append(parts, value[i:i+2])
+			}
+			value = strings.Join(parts, ":")
+		}
+		return parseHexBytes(value)
+	case optionTypeRoutes:
+		var routes []Route
+		if err := json.Unmarshal(o.Value, &routes); err != nil {
+			return nil, maskAny(err)
+		}
+		return encodeRoutes(routes)
+	case optionTypeDomainList:
+		values, err := unmarshalStringList(o.Value)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return encodeDomainList(values)
+	default:
+		return nil, maskAny(fmt.Errorf("Unknown option type '%s'", o.Type))
+	}
+}
+
+// Route is a classless static route.
+type Route struct {
+	Destination string `json:"destination"` // Destination network in CIDR notation
+	Gateway     string `json:"gateway"`     // Address of the router
+}
+
+// encodeRoutes encodes the given routes as a classless static route option (RFC 3442).
+// Every route is encoded as the prefix length, the significant bytes of the
+// destination and the router address.
+func encodeRoutes(routes []Route) ([]byte, error) {
+	if len(routes) == 0 {
+		return nil, maskAny(fmt.Errorf("No routes"))
+	}
+	var data []byte
+	for _, r := range routes {
+		_, destination, err := net.ParseCIDR(r.Destination)
+		if err != nil || destination.IP.To4() == nil {
+			return nil, maskAny(fmt.Errorf("Failed to parse route destination '%s'", r.Destination))
+		}
+		gateway := parseIP(r.Gateway)
+		if gateway == nil || gateway.To4() == nil {
+			return nil, maskAny(fmt.Errorf("Failed to parse route gateway '%s'", r.Gateway))
+		}
+		ones, _ := destination.Mask.Size()
+		data = append(data, byte(ones))
+		data = append(data, destination.IP.To4()[:(ones+7)/8]...)
+		data = append(data, gateway.To4()...)
+	}
+	return data, nil
+}
+
+// encodeDomainList encodes the given domain names as a domain search list (RFC 3397).
+// Names are encoded in wire format, where a suffix that is already encoded is
+// replaced by a pointer to its earlier occurrence (RFC 1035 section 4.1.4).
+// Pointers are offsets in the complete option value, which can be longer than
+// a single option instance.
+func encodeDomainList(names []string) ([]byte, error) {
+	if len(names) == 0 {
+		return nil, maskAny(fmt.Errorf("No domain names"))
+	}
+	var data []byte
+	offsets := make(map[string]int) // Encoded suffix -> offset
+	for _, name := range names {
+		if err := validateDomainName(name); err != nil {
+			return nil, maskAny(err)
+		}
+		labels := strings.Split(canonicalDomainName(name), ".")
+		compressed := false
+		for i, label := range labels {
+			suffix := strings.Join(labels[i:], ".")
+			if offset, found := offsets[suffix]; found {
+				data = append(data, 0xc0|byte(offset>>8), byte(offset))
+				compressed = true
+				break
+			}
+			if len(data) < 0x4000 {
+				// Offset fits in a pointer
+				offsets[suffix] = len(data)
+			}
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+		if !compressed {
+			data = append(data, 0)
+		}
+	}
+	return data, nil
+}
+
+// validateDomainName checks that the given name is a valid domain name.
+func validateDomainName(name string) error {
+	name = canonicalDomainName(name)
+	if name == "" || len(name) > 253 {
+		return maskAny(fmt.Errorf("Invalid domain name '%s'", name))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !isValidHostname(label) {
+			return maskAny(fmt.Errorf("Invalid domain name '%s'", name))
+		}
+	}
+	return nil
+}
+
+// decodeDomainList decodes a domain search list (RFC 3397) from the given instances
+// of the option. The instances are concatenated first (RFC 3396), since pointers
+// are offsets in the complete option value.
+func decodeDomainList(instances ...[]byte) ([]string, error) {
+	var data []byte
+	for _, value := range instances {
+		data = append(data, value...)
+	}
+	var names []string
+	for offset := 0; offset < len(data); {
+		var labels []string
+		next := -1 // Offset of the next name, set after the first pointer
+		for pos, jumps := offset, 0; ; {
+			if pos >= len(data) {
+				return nil, maskAny(fmt.Errorf("Domain name at offset %d is truncated", offset))
+			}
+			size := int(data[pos])
+			if size == 0 {
+				if next < 0 {
+					next = pos + 1
+				}
+				break
+			}
+			if size&0xc0 == 0xc0 {
+				if pos+1 >= len(data) {
+					return nil, maskAny(fmt.Errorf("Pointer at offset %d is truncated", pos))
+				}
+				target := (size&0x3f)<<8 | int(data[pos+1])
+				if target >= pos || jumps > len(data) {
+					// Only pointers to earlier names are valid, this also prevents loops
+					return nil, maskAny(fmt.Errorf("Invalid pointer at offset %d", pos))
+				}
+				if next < 0 {
+					next = pos + 2
+				}
+				pos = target
+				jumps++
+				continue
+			}
+			if size > maxHostnameLength || pos+1+size > len(data) {
+				return nil, maskAny(fmt.Errorf("Invalid label at offset %d", pos))
+			}
+			labels = append(labels, string(data[pos+1:pos+1+size]))
+			pos += 1 + size
+		}
+		names = append(names, strings.Join(labels, "."))
+		offset = next
+	}
+	return names, nil
+}
+
+// splitLongOptions returns the given options, with every option that is longer than
+// a single option instance split into multiple instances of that option (RFC 3396).
+func splitLongOptions(options []dhcp.Option) []dhcp.Option {
+	var result []dhcp.Option
+	for _, o := range options {
+		value := o.Value
+		for len(value) > maxOptionLength {
+			result = append(result, dhcp.Option{Code: o.Code, Value: value[:maxOptionLength]})
+			value = value[maxOptionLength:]
+		}
+		result = append(result, dhcp.Option{Code: o.Code, Value: value})
+	}
+	return result
+}
+
+// encodeIPs encodes the given IPv4 addresses.
+func encodeIPs(values []string) ([]byte, error) {
+	if len(values) == 0 {
+		return nil, maskAny(fmt.Errorf("No addresses"))
+	}
+	var data []byte
+	for _, v := range values {
+		ip := parseIP(v)
+		if ip == nil || ip.To4() == nil {
+			return nil, maskAny(fmt.Errorf("Failed to parse address '%s'", v))
+		}
+		data = append(data, ip.To4()...)
+	}
+	return data, nil
+}
+
+// unmarshalStringList unmarshals a list of strings, or a single comma separated string.
+func unmarshalStringList(raw json.RawMessage) ([]string, error) {
+	var values []string
+	if err := json.Unmarshal(raw, &values); err == nil {
+		return values, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, maskAny(err)
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// mergeCustomOptions returns the given options, with all options that are
+// also in the given overrides replaced.
+func mergeCustomOptions(options, overrides []CustomOption) []CustomOption {
+	if len(overrides) == 0 {
+		return options
+	}
+	result := make([]CustomOption, 0, len(options)+len(overrides))
+	for _, o := range options {
+		overridden := false
+		for _, override := range overrides {
+			if override.Code == o.Code {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result = append(result, o)
+		}
+	}
+	return append(result, overrides...)
+}
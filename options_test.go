@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// TestDomainListRFC3397Example checks the encoding of the example in RFC 3397 section 2.
+func TestDomainListRFC3397Example(t *testing.T) {
+	names := []string{"eng.apple.com", "marketing.apple.com"}
+	expected := []byte{
+		3, 'e', 'n', 'g', 5, 'a', 'p', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		9, 'm', 'a', 'r', 'k', 'e', 't', 'i', 'n', 'g', 0xc0, 0x04,
+	}
+	data, err := encodeDomainList(names)
+	if err != nil {
+		t.Fatalf("encodeDomainList failed: %v", err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %v, got %v", expected, data)
+	}
+	decoded, err := decodeDomainList(data)
+	if err != nil {
+		t.Fatalf("decodeDomainList failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, names) {
+		t.Errorf("Expected %v, got %v", names, decoded)
+	}
+}
+
+// TestDomainListLong checks that a domain search list longer than a single option instance
+// survives splitting it over multiple instances in a packet.
+func TestDomainListLong(t *testing.T) {
+	var names []string
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("rack%02d.site%02d.example.com", i, i%4))
+	}
+	data, err := encodeDomainList(names)
+	if err != nil {
+		t.Fatalf("encodeDomainList failed: %v", err)
+	}
+	if len(data) <= maxOptionLength {
+		t.Fatalf("Expected a list longer than %d bytes, got %d", maxOptionLength, len(data))
+	}
+
+	p := dhcp.NewPacket(dhcp.BootRequest)
+	res := dhcp.ReplyPacket(p, dhcp.ACK, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 10).To4(), time.Hour,
+		splitLongOptions([]dhcp.Option{{Code: dhcp.OptionDomainSearch, Value: data}}))
+	instances := optionInstances(res, dhcp.OptionDomainSearch)
+	if len(instances) < 2 {
+		t.Fatalf("Expected multiple option instances, got %d", len(instances))
+	}
+	for _, value := range instances {
+		if len(value) > maxOptionLength {
+			t.Errorf("Option instance of %d bytes is too long", len(value))
+		}
+	}
+	decoded, err := decodeDomainList(instances...)
+	if err != nil {
+		t.Fatalf("decodeDomainList failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, names) {
+		t.Errorf("Expected %v, got %v", names, decoded)
+	}
+}
+
+// TestDomainListInvalidPointer checks that pointers to the current or a later offset are rejected.
+func TestDomainListInvalidPointer(t *testing.T) {
+	if _, err := decodeDomainList([]byte{3, 'c', 'o', 'm', 0xc0, 0x04}); err == nil {
+		t.Error("Expected an error for a pointer to itself")
+	}
+}
+
+// optionInstances returns the values of all instances of the option with given code in the given packet.
+func optionInstances(p dhcp.Packet, code dhcp.OptionCode) [][]byte {
+	var result [][]byte
+	opts := p.Options()
+	for len(opts) >= 2 && dhcp.OptionCode(opts[0]) != dhcp.End {
+		if dhcp.OptionCode(opts[0]) == dhcp.Pad {
+			opts = opts[1:]
+			continue
+		}
+		size := int(opts[1])
+		if dhcp.OptionCode(opts[0]) == code {
+			result = append(result, opts[2:2+size])
+		}
+		opts = opts[2+size:]
+	}
+	return result
+}
+
+// TestCustomOptionEncode checks the wire format of typed options and that they
+// survive a round trip through a packet.
+func TestCustomOptionEncode(t *testing.T) {
+	tests := []struct {
+		Option   CustomOption
+		Expected []byte
+	}{
+		{CustomOption{Name: "ntp-servers", Value: []byte(`["10.0.0.1", "10.0.0.2"]`)}, []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{CustomOption{Name: "ntp-servers", Value: []byte(`"10.0.0.1, 10.0.0.2"`)}, []byte{10, 0, 0, 1, 10, 0, 0, 2}},
+		{CustomOption{Code: 150, Type: "ip", Value: []byte(`"192.168.1.1"`)}, []byte{192, 168, 1, 1}},
+		{CustomOption{Code: 26, Type: "uint16", Value: []byte(`1500`)}, []byte{0x05, 0xdc}},
+		{CustomOption{Code: 23, Type: "uint8", Value: []byte(`64`)}, []byte{64}},
+		{CustomOption{Code: 2, Type: "uint32", Value: []byte(`3600`)}, []byte{0, 0, 0x0e, 0x10}},
+		{CustomOption{Code: 19, Type: "bool", Value: []byte(`true`)}, []byte{1}},
+		{CustomOption{Name: "wpad-url", Value: []byte(`"http://wpad/wpad.dat"`)}, []byte("http://wpad/wpad.dat")},
+		{CustomOption{Code: 224, Type: "hex", Value: []byte(`"01:0a:ff"`)}, []byte{0x01, 0x0a, 0xff}},
+		{CustomOption{Code: 224, Type: "hex", Value: []byte(`"010aff"`)}, []byte{0x01, 0x0a, 0xff}},
+	}
+	for _, test := range tests {
+		o := test.Option
+		if err := o.Validate(); err != nil {
+			t.Errorf("Option %s %d: Validate failed: %v", o.Name, o.Code, err)
+			continue
+		}
+		data, err := o.Encode()
+		if err != nil {
+			t.Errorf("Option %d: Encode failed: %v", o.Code, err)
+			continue
+		}
+		if !bytes.Equal(data, test.Expected) {
+			t.Errorf("Option %d: Expected %v, got %v", o.Code, test.Expected, data)
+		}
+		p := dhcp.NewPacket(dhcp.BootRequest)
+		res := dhcp.ReplyPacket(p, dhcp.ACK, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 10).To4(), time.Hour,
+			[]dhcp.Option{{Code: dhcp.OptionCode(o.Code), Value: data}})
+		if value := res.ParseOptions()[dhcp.OptionCode(o.Code)]; !bytes.Equal(value, test.Expected) {
+			t.Errorf("Option %d: Expected %v after round trip, got %v", o.Code, test.Expected, value)
+		}
+	}
+}
+
+// TestCustomOptionInvalid checks that invalid typed options are rejected.
+func TestCustomOptionInvalid(t *testing.T) {
+	tests := []CustomOption{
+		{Code: 224, Type: "hex", Value: []byte(`"abc"`)},
+		{Code: 224, Type: "hex", Value: []byte(`"01:0a:fff"`)},
+		{Code: 224, Type: "hex", Value: []byte(`"0g"`)},
+		{Code: 23, Type: "uint8", Value: []byte(`256`)},
+		{Code: 26, Type: "uint16", Value: []byte(`-1`)},
+		{Code: 150, Type: "ip", Value: []byte(`"10.0.0"`)},
+		{Code: 224, Type: "string", Value: []byte(`""`)},
+		{Code: 224, Type: "float", Value: []byte(`1.5`)},
+		{Name: "ntp-servers", Code: 1, Value: []byte(`"10.0.0.1"`)},
+		{Code: 51, Type: "uint32", Value: []byte(`3600`)}, // Managed by the server
+	}
+	for _, o := range tests {
+		if err := o.Validate(); err == nil {
+			t.Errorf("Expected option %s %d with value %s to be invalid", o.Name, o.Code, o.Value)
+		}
+	}
+}
+
+// TestRoutesEncode checks the encoding of classless static routes (RFC 3442 section 3)
+// and that they survive a round trip through a packet.
+func TestRoutesEncode(t *testing.T) {
+	options := DHCPOptions{
+		RouterIP: "10.0.0.1",
+		Routes: []Route{
+			{Destination: "10.244.0.0/16", Gateway: "10.0.0.5"},
+			{Destination: "10.96.0.0/12", Gateway: "10.0.0.5"},
+			{Destination: "192.168.100.128/25", Gateway: "0.0.0.0"},
+		},
+	}
+	if err := options.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	data, err := encodeRoutes(options.routesWithDefault())
+	if err != nil {
+		t.Fatalf("encodeRoutes failed: %v", err)
+	}
+	expected := []byte{
+		16, 10, 244, 10, 0, 0, 5,
+		12, 10, 96, 10, 0, 0, 5,
+		25, 192, 168, 100, 128, 0, 0, 0, 0,
+		0, 10, 0, 0, 1, // Default route via the router
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %v, got %v", expected, data)
+	}
+
+	p := dhcp.NewPacket(dhcp.BootRequest)
+	res := dhcp.ReplyPacket(p, dhcp.ACK, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 10).To4(), time.Hour,
+		[]dhcp.Option{{Code: optionClasslessStaticRoute, Value: data}})
+	decoded, err := decodeRoutes(res.ParseOptions()[optionClasslessStaticRoute])
+	if err != nil {
+		t.Fatalf("decodeRoutes failed: %v", err)
+	}
+	if expected := options.routesWithDefault(); !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected %v after round trip, got %v", expected, decoded)
+	}
+}
+
+// TestMultiValueOptions checks that the single router and DNS server are added in front of the lists,
+// and that routers and gateways must be in the subnet.
+func TestMultiValueOptions(t *testing.T) {
+	options := DHCPOptions{
+		RouterIP:    "10.0.0.1",
+		Routers:     []string{"10.0.0.2"},
+		DNSServerIP: "10.0.0.53",
+		DNSServers:  []string{"10.0.1.53"},
+		Routes:      []Route{{Destination: "10.244.0.0/16", Gateway: "10.0.0.5"}},
+	}
+	if err := options.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if data, _ := encodeIPs(options.Routers); !bytes.Equal(data, []byte{10, 0, 0, 1, 10, 0, 0, 2}) {
+		t.Errorf("Unexpected routers %v", data)
+	}
+	if data, _ := encodeIPs(options.DNSServers); !bytes.Equal(data, []byte{10, 0, 0, 53, 10, 0, 1, 53}) {
+		t.Errorf("Unexpected DNS servers %v", data)
+	}
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+	if err := options.ValidateInSubnet(subnet); err != nil {
+		t.Errorf("ValidateInSubnet failed: %v", err)
+	}
+	_, other, _ := net.ParseCIDR("10.0.1.0/24")
+	if err := options.ValidateInSubnet(other); err == nil {
+		t.Error("Expected routers outside the subnet to be rejected")
+	}
+	invalid := DHCPOptions{Routes: []Route{{Destination: "10.244.0.0", Gateway: "10.0.0.5"}}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Expected a route without prefix length to be rejected")
+	}
+}
+
+// decodeRoutes decodes a classless static route option (RFC 3442).
+func decodeRoutes(data []byte) ([]Route, error) {
+	var routes []Route
+	for len(data) > 0 {
+		ones := int(data[0])
+		size := (ones + 7) / 8
+		if ones > 32 || len(data) < 1+size+4 {
+			return nil, fmt.Errorf("Invalid route at %v", data)
+		}
+		destination := make(net.IP, 4)
+		copy(destination, data[1:1+size])
+		gateway := net.IP(data[1+size : 1+size+4])
+		routes = append(routes, Route{
+			Destination: fmt.Sprintf("%s/%d", destination, ones),
+			Gateway:     gateway.String(),
+		})
+		data = data[1+size+4:]
+	}
+	return routes, nil
+}
+
+// TestVendorSubOptionsEncode checks the encoding of vendor sub-options (RFC 2132 section 8.4),
+// the override of sub-options by later classes, and a round trip through a packet.
+func TestVendorSubOptionsEncode(t *testing.T) {
+	subOptions := []VendorSubOption{
+		{Code: 1, Type: "ip", Value: []byte(`"10.0.0.10"`)},
+		{Code: 2, Type: "string", Value: []byte(`"http://provision/"`)},
+	}
+	overrides := []VendorSubOption{
+		{Code: 1, Type: "ip-list", Value: []byte(`["10.0.0.11", "10.0.0.12"]`)},
+	}
+	if err := validateVendorSubOptions(subOptions); err != nil {
+		t.Fatalf("validateVendorSubOptions failed: %v", err)
+	}
+	data, err := encodeVendorSubOptions(mergeVendorSubOptions(subOptions, overrides))
+	if err != nil {
+		t.Fatalf("encodeVendorSubOptions failed: %v", err)
+	}
+	expected := append([]byte{2, 17}, "http://provision/"...)
+	expected = append(expected, 1, 8, 10, 0, 0, 11, 10, 0, 0, 12)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %v, got %v", expected, data)
+	}
+
+	p := dhcp.NewPacket(dhcp.BootRequest)
+	res := dhcp.ReplyPacket(p, dhcp.ACK, net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 10).To4(), time.Hour,
+		[]dhcp.Option{{Code: dhcp.OptionVendorSpecificInformation, Value: data}})
+	decoded := make(map[byte][]byte)
+	for value := res.ParseOptions()[dhcp.OptionVendorSpecificInformation]; len(value) >= 2; {
+		size := int(value[1])
+		if len(value) < 2+size {
+			t.Fatalf("Truncated sub-option %d", value[0])
+		}
+		decoded[value[0]] = value[2 : 2+size]
+		value = value[2+size:]
+	}
+	if !bytes.Equal(decoded[1], []byte{10, 0, 0, 11, 10, 0, 0, 12}) || string(decoded[2]) != "http://provision/" {
+		t.Errorf("Unexpected sub-options after round trip: %v", decoded)
+	}
+}
+
+// TestVendorSubOptionsInvalid checks that invalid vendor sub-options are rejected.
+func TestVendorSubOptionsInvalid(t *testing.T) {
+	long := []byte(fmt.Sprintf("%q", bytes.Repeat([]byte("x"), 200)))
+	tests := [][]VendorSubOption{
+		{{Code: 0, Type: "uint8", Value: []byte(`1`)}},
+		{{Code: 1, Value: []byte(`1`)}},
+		{{Code: 1, Type: "uint8", Value: []byte(`1`)}, {Code: 1, Type: "uint8", Value: []byte(`2`)}},
+		{{Code: 1, Type: "hex", Value: []byte(`"abc"`)}},
+		{{Code: 1, Type: "string", Value: long}, {Code: 2, Type: "string", Value: long}}, // Does not fit in one option
+	}
+	for _, subOptions := range tests {
+		if err := validateVendorSubOptions(subOptions); err == nil {
+			t.Errorf("Expected sub-options %v to be invalid", subOptions)
+		}
+	}
+}
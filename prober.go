@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// protocolICMP is the IANA protocol number of ICMP for IPv4.
+	protocolICMP = 1
+)
+
+// Prober checks if an IP address is already in use.
+type Prober interface {
+	// IsInUse returns true if a host responds on the given IP address
+	// within the given timeout.
+	IsInUse(ip net.IP, timeout time.Duration) (bool, error)
+}
+
+type icmpProber struct {
+	seq uint32
+}
+
+// NewICMPProber creates a Prober that sends an ICMP echo request to the address.
+// This requires permission to open raw sockets.
+func NewICMPProber() Prober {
+	return &icmpProber{}
+}
+
+// IsInUse returns true if a host responds on the given IP address
+// within the given timeout.
+func (p *icmpProber) IsInUse(ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, maskAny(err)
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	seq := int(atomic.AddUint32(&p.seq, 1) & 0xffff)
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: []byte("kube-dhcp"),
+		},
+	}
+	data, err := msg.Marshal(nil)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if _, err := conn.WriteTo(data, &net.IPAddr{IP: ip}); err != nil {
+		return false, maskAny(err)
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, maskAny(err)
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				// No response
+				return false, nil
+			}
+			return false, maskAny(err)
+		}
+		if peerAddr, ok := peer.(*net.IPAddr); !ok || !peerAddr.IP.Equal(ip) {
+			continue
+		}
+		reply, err := icmp.ParseMessage(protocolICMP, buffer[:n])
+		if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
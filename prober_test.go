@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// fakeProber is a Prober that reports a fixed set of addresses as in use.
+type fakeProber struct {
+	inUse  map[string]bool
+	probed []string
+}
+
+// IsInUse returns true if the given IP is in the set of used addresses.
+func (p *fakeProber) IsInUse(ip net.IP, timeout time.Duration) (bool, error) {
+	p.probed = append(p.probed, ip.String())
+	return p.inUse[ip.String()], nil
+}
+
+func TestProbeQuarantinesUsedAddresses(t *testing.T) {
+	h := newTestHandler(t)
+	// All addresses of the range except the last one are in use
+	prober := &fakeProber{inUse: make(map[string]bool)}
+	for i := 100; i < 109; i++ {
+		prober.inUse[net.IPv4(192, 168, 10, byte(i)).String()] = true
+	}
+	h.prober = prober
+
+	var offered net.IP
+	for attempt := 0; attempt < 10 && offered == nil; attempt++ {
+		res := serveTestPacket(h, dhcp.Discover, nil, nil)
+		if res != nil {
+			offered = res.YIAddr()
+		}
+		if len(prober.probed) > maxProbeAttempts*(attempt+1) {
+			t.Fatalf("Expected at most %d probes per discover, got %d", maxProbeAttempts, len(prober.probed))
+		}
+	}
+	if !offered.Equal(net.IPv4(192, 168, 10, 109)) {
+		t.Fatalf("Expected offer of 192.168.10.109, got %s", offered)
+	}
+
+	for _, ip := range prober.probed {
+		if !prober.inUse[ip] {
+			continue
+		}
+		l, err := h.leases.GetByIP(ip)
+		if err != nil {
+			t.Errorf("Expected lease for probed IP %s: %v", ip, err)
+		} else if l.GetState() != LeaseStateQuarantined {
+			t.Errorf("Expected IP %s to be quarantined, got %s", ip, l.GetState())
+		}
+	}
+	// Quarantined addresses are not probed again
+	seen := make(map[string]bool)
+	for _, ip := range prober.probed {
+		if seen[ip] {
+			t.Errorf("IP %s probed more than once", ip)
+		}
+		seen[ip] = true
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Relay agent information sub-options (RFC 3046, RFC 3527)
+const (
+	relayAgentCircuitID     = 1
+	relayAgentRemoteID      = 2
+	relayAgentLinkSelection = 5
+)
+
+// RelayAgentInfo holds the decoded relay agent information option (82).
+type RelayAgentInfo struct {
+	CircuitID     []byte
+	RemoteID      []byte
+	LinkSelection net.IP
+}
+
+// parseRelayAgentInfo decodes the relay agent information option found
+// in the given options.
+// Returns nil if there is no (valid) relay agent information option.
+func parseRelayAgentInfo(options dhcp.Options) *RelayAgentInfo {
+	data, ok := options[dhcp.OptionRelayAgentInformation]
+	if !ok {
+		return nil
+	}
+	info := &RelayAgentInfo{}
+	for len(data) >= 2 {
+		code, size := data[0], int(data[1])
+		if len(data) < 2+size {
+			return nil
+		}
+		value := data[2 : 2+size]
+		switch code {
+		case relayAgentCircuitID:
+			info.CircuitID = value
+		case relayAgentRemoteID:
+			info.RemoteID = value
+		case relayAgentLinkSelection:
+			if size == 4 {
+				info.LinkSelection = net.IP(value)
+			}
+		}
+		data = data[2+size:]
+	}
+	return info
+}
+
+// RelayAgentMatch is a condition on the relay agent information of a request.
+// Values are given as plain text or as colon separated hex bytes.
+type RelayAgentMatch struct {
+	CircuitID string `json:"circuit-id,omitempty"`
+	RemoteID  string `json:"remote-id,omitempty"`
+}
+
+// IsEmpty returns true if the match has no conditions.
+func (m RelayAgentMatch) IsEmpty() bool {
+	return m.CircuitID == "" && m.RemoteID == ""
+}
+
+// Matches returns true if the given relay agent information satisfies
+// all conditions of this match.
+// An empty match matches everything.
+func (m RelayAgentMatch) Matches(info *RelayAgentInfo) bool {
+	if m.IsEmpty() {
+		return true
+	}
+	if info == nil {
+		return false
+	}
+	if m.CircuitID != "" && !matchRelayAgentValue(m.CircuitID, info.CircuitID) {
+		return false
+	}
+	if m.RemoteID != "" && !matchRelayAgentValue(m.RemoteID, info.RemoteID) {
+		return false
+	}
+	return true
+}
+
+// matchRelayAgentValue returns true if the given value equals the given expected
+// text, or its colon separated hex representation.
+func matchRelayAgentValue(expected string, value []byte) bool {
+	if len(value) == 0 {
+		return false
+	}
+	return string(value) == expected || formatHexBytes(value) == strings.ToLower(expected)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Reservation pins a client to a fixed IP address.
+// A client is identified by its hardware address and/or its client identifier (option 61),
+// and/or the relay agent information (option 82) of its requests.
+type Reservation struct {
+	CHAddr     string          `json:"chaddr,omitempty"`      // Hardware address of the client
+	ClientID   string          `json:"client-id,omitempty"`   // Client identifier (option 61) as colon separated hex bytes
+	RelayAgent RelayAgentMatch `json:"relay-agent,omitempty"` // Relay agent information of the client
+	IP         string          `json:"ip"`                    // Reserved IP address
+	Hostname   string          `json:"hostname,omitempty"`    // Hostname given to the client (option 12)
+	Options    DHCPOptions     `json:"options,omitempty"`     // Options overriding the default options
+}
+
+// Validate changes the values in the given reservation.
+// Returns nil if all ok, otherwise an error.
+func (r *Reservation) Validate() error {
+	if r.CHAddr == "" && r.ClientID == "" && r.RelayAgent.IsEmpty() {
+		return maskAny(fmt.Errorf("Reservation for '%s' must have a chaddr, client-id or relay-agent", r.IP))
+	}
+	if r.CHAddr != "" {
+		mac, err := net.ParseMAC(r.CHAddr)
+		if err != nil {
+			return maskAny(fmt.Errorf("Failed to parse reservation chaddr '%s'", r.CHAddr))
+		}
+		r.CHAddr = mac.String()
+	}
+	if r.ClientID != "" {
+		id, err := parseHexBytes(r.ClientID)
+		if err != nil {
+			return maskAny(fmt.Errorf("Failed to parse reservation client-id '%s'", r.ClientID))
+		}
+		r.ClientID = formatHexBytes(id)
+	}
+	if ip := parseIP(r.IP); ip == nil || ip.To4() == nil {
+		return maskAny(fmt.Errorf("Failed to parse reservation ip '%s'", r.IP))
+	}
+	if err := r.Options.Validate(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// Matches returns true if this reservation is for the client with given
+// hardware address, client identifier and relay agent information.
+// If the reservation specifies a client identifier, that must match,
+// otherwise the hardware address (if specified) must match.
+// If the reservation specifies relay agent information, that must match as well.
+func (r Reservation) Matches(chAddr, clientID string, info *RelayAgentInfo) bool {
+	if r.ClientID != "" {
+		if r.ClientID != clientID {
+			return false
+		}
+	} else if r.CHAddr != "" && r.CHAddr != chAddr {
+		return false
+	}
+	return r.RelayAgent.Matches(info)
+}
+
+// clientIDFromOptions returns the client identifier (option 61) found in the given options
+// formatted as colon separated hex bytes, or an empty string if there is none.
+func clientIDFromOptions(options dhcp.Options) string {
+	if id, ok := options[dhcp.OptionClientIdentifier]; ok && len(id) > 0 {
+		return formatHexBytes(id)
+	}
+	return ""
+}
+
+// parseHexBytes parses a string of colon separated hex bytes.
+func parseHexBytes(input string) ([]byte, error) {
+	var result []byte
+	for _, part := range strings.Split(input, ":") {
+		if len(part) == 0 || len(part) > 2 {
+			return nil, maskAny(fmt.Errorf("Invalid hex byte '%s'", part))
+		}
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, maskAny(fmt.Errorf("Invalid hex byte '%s'", part))
+		}
+		result = append(result, byte(b))
+	}
+	return result, nil
+}
+
+// formatHexBytes formats the given bytes as colon separated lowercase hex bytes.
+func formatHexBytes(data []byte) string {
+	parts := make([]string, len(data))
+	for i, b := range data {
+		parts[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DNS record types & classes used in dynamic updates
+	dnsTypeA     = 1
+	dnsTypeSOA   = 6
+	dnsTypePTR   = 12
+	dnsTypeDHCID = 49
+	dnsTypeTSIG  = 250
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+	dnsClassANY  = 255
+	dnsClassNONE = 254
+	// dnsOpcodeUpdate is the opcode of a dynamic update message (RFC 2136).
+	dnsOpcodeUpdate = 5
+	// Response codes of failed prerequisites
+	dnsRcodeYXDomain = 6 // Name exists when it should not
+	dnsRcodeNXRRSet  = 8 // RRset does not exist when it should
+	// Identifier types of a DHCID record (RFC 4701 section 3.3)
+	dhcidTypeCHAddr   = 0x0000 // Hardware type and address
+	dhcidTypeClientID = 0x0001 // Client identifier option
+	// dhcidDigestSHA256 is the digest type of a DHCID record.
+	dhcidDigestSHA256 = 1
+	// dnsUpdateTimeout is the time to wait for the response to a dynamic update.
+	dnsUpdateTimeout = 5 * time.Second
+	// tsigFudge is the allowed clock skew of a signed message.
+	tsigFudge = 300
+	// defaultTSIGAlgorithm is the TSIG algorithm used when none is configured.
+	defaultTSIGAlgorithm = "hmac-sha256"
+)
+
+// TSIGConfig holds the key used to sign dynamic updates (RFC 8945).
+type TSIGConfig struct {
+	// Name of the key
+	Name string `json:"name"`
+	// Algorithm of the key: hmac-md5, hmac-sha1, hmac-sha256 (default) or hmac-sha512
+	Algorithm string `json:"algorithm,omitempty"`
+	// Base64 encoded secret of the key
+	Secret string `json:"secret,omitempty"`
+	// Path of a file containing the base64 encoded secret of the key (e.g. a mounted Secret)
+	SecretFile string `json:"secret-file,omitempty"`
+}
+
+// tsigAlgorithms maps the supported TSIG algorithms to their name and hash function.
+var tsigAlgorithms = map[string]struct {
+	name string
+	hash func() hash.Hash
+}{
+	"hmac-md5":    {"hmac-md5.sig-alg.reg.int.", md5.New},
+	"hmac-sha1":   {"hmac-sha1.", sha1.New},
+	"hmac-sha256": {"hmac-sha256.", sha256.New},
+	"hmac-sha512": {"hmac-sha512.", sha512.New},
+}
+
+// Validate changes the values in the given config.
+// Returns nil if all ok, otherwise an error.
+func (c *TSIGConfig) Validate() error {
+	if c.Name == "" {
+		return maskAny(fmt.Errorf("TSIG key must have a name"))
+	}
+	c.Name = canonicalDomainName(c.Name)
+	if c.Algorithm == "" {
+		c.Algorithm = defaultTSIGAlgorithm
+	}
+	c.Algorithm = strings.ToLower(c.Algorithm)
+	if _, found := tsigAlgorithms[c.Algorithm]; !found {
+		return maskAny(fmt.Errorf("Unknown TSIG algorithm '%s'", c.Algorithm))
+	}
+	if (c.Secret == "") == (c.SecretFile == "") {
+		return maskAny(fmt.Errorf("TSIG key '%s' must have either a secret or a secret-file", c.Name))
+	}
+	if c.Secret != "" {
+		if _, err := base64.StdEncoding.DecodeString(c.Secret); err != nil {
+			return maskAny(fmt.Errorf("Failed to decode secret of TSIG key '%s'", c.Name))
+		}
+	}
+	return nil
+}
+
+// getSecret returns the decoded secret of the key.
+func (c TSIGConfig) getSecret() ([]byte, error) {
+	encoded := c.Secret
+	if c.SecretFile != "" {
+		data, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, maskAny(fmt.Errorf("Failed to decode secret of TSIG key '%s'", c.Name))
+	}
+	return secret, nil
+}
+
+type rfc2136DNSUpdater struct {
+	server      string
+	zone        string
+	reverseZone string
+	ttl         uint32
+	tsig        *TSIGConfig
+	tsigSecret  []byte
+}
+
+// NewRFC2136DNSUpdater creates a DNSUpdater that sends dynamic updates (RFC 2136)
+// to the DNS server of the given config, optionally signed with a TSIG key.
+func NewRFC2136DNSUpdater(config DNSUpdateConfig) (DNSUpdater, error) {
+	server := config.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	u := &rfc2136DNSUpdater{
+		server:      server,
+		zone:        canonicalDomainName(config.Zone),
+		reverseZone: canonicalDomainName(config.ReverseZone),
+		ttl:         uint32(config.GetTTL() / time.Second),
+		tsig:        config.TSIG,
+	}
+	if u.tsig != nil {
+		secret, err := u.tsig.getSecret()
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		u.tsigSecret = secret
+	}
+	return u, nil
+}
+
+// Add (or replace) the forward and reverse records of the given lease.
+// The name is marked with a DHCID record of the client, an existing name is only
+// replaced when it has the DHCID record of the same client (RFC 4703 section 5.3).
+func (u *rfc2136DNSUpdater) Update(l Lease) error {
+	fqdn, ip, reverse, err := u.names(l)
+	if err != nil {
+		return maskAny(err)
+	}
+	dhcid, err := dhcidData(l, fqdn)
+	if err != nil {
+		return maskAny(err)
+	}
+	// Add the name if it does not exist yet
+	err = u.send(u.zone, []dnsRecord{{name: fqdn, rrType: dnsTypeANY, class: dnsClassNONE}},
+		dnsRecord{name: fqdn, rrType: dnsTypeA, class: dnsClassIN, ttl: u.ttl, data: ip},
+		dnsRecord{name: fqdn, rrType: dnsTypeDHCID, class: dnsClassIN, ttl: u.ttl, data: dhcid},
+	)
+	if isDNSRcode(err, dnsRcodeYXDomain) {
+		// Name exists, replace the A records if the name belongs to this client
+		err = u.send(u.zone, []dnsRecord{{name: fqdn, rrType: dnsTypeDHCID, class: dnsClassIN, data: dhcid}},
+			dnsRecord{name: fqdn, rrType: dnsTypeA, class: dnsClassANY},
+			dnsRecord{name: fqdn, rrType: dnsTypeA, class: dnsClassIN, ttl: u.ttl, data: ip},
+		)
+		if isDNSRcode(err, dnsRcodeNXRRSet) {
+			return maskAny(fmt.Errorf("Name '%s' is in use by another host", fqdn))
+		}
+	}
+	if err != nil {
+		return maskAny(err)
+	}
+	// Replace the PTR records of the address
+	if err := u.send(u.getReverseZone(ip), nil,
+		dnsRecord{name: reverse, rrType: dnsTypePTR, class: dnsClassANY},
+		dnsRecord{name: reverse, rrType: dnsTypePTR, class: dnsClassIN, ttl: u.ttl, data: encodeDomainName(fqdn)},
+	); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// Remove the forward and reverse records of the given lease.
+// Only the records pointing to the address of the lease are removed, and only
+// when the name has the DHCID record of the client of the lease (RFC 4703 section 5.5).
+func (u *rfc2136DNSUpdater) Remove(l Lease) error {
+	fqdn, ip, reverse, err := u.names(l)
+	if err != nil {
+		return maskAny(err)
+	}
+	dhcid, err := dhcidData(l, fqdn)
+	if err != nil {
+		return maskAny(err)
+	}
+	err = u.send(u.zone, []dnsRecord{{name: fqdn, rrType: dnsTypeDHCID, class: dnsClassIN, data: dhcid}},
+		dnsRecord{name: fqdn, rrType: dnsTypeA, class: dnsClassNONE, data: ip},
+		dnsRecord{name: fqdn, rrType: dnsTypeDHCID, class: dnsClassANY},
+	)
+	if isDNSRcode(err, dnsRcodeNXRRSet) {
+		// Name does not belong to this client (anymore)
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	}
+	if err := u.send(u.getReverseZone(ip), nil,
+		dnsRecord{name: reverse, rrType: dnsTypePTR, class: dnsClassNONE, data: encodeDomainName(fqdn)},
+	); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// names returns the FQDN, IP address and reverse name of the given lease.
+func (u *rfc2136DNSUpdater) names(l Lease) (string, net.IP, string, error) {
+	ip := parseIP(l.IP).To4()
+	if ip == nil {
+		return "", nil, "", maskAny(fmt.Errorf("Invalid lease IP '%s'", l.IP))
+	}
+	fqdn := canonicalDomainName(l.FQDN)
+	if fqdn != u.zone && !strings.HasSuffix(fqdn, "."+u.zone) {
+		return "", nil, "", maskAny(fmt.Errorf("FQDN '%s' is not in zone '%s'", l.FQDN, u.zone))
+	}
+	return fqdn, ip, reverseDomainName(ip), nil
+}
+
+// getReverseZone returns the zone containing the reverse name of the given address.
+func (u *rfc2136DNSUpdater) getReverseZone(ip net.IP) string {
+	if u.reverseZone != "" {
+		return u.reverseZone
+	}
+	return fmt.Sprintf("%d.%d.%d.in-addr.arpa", ip[2], ip[1], ip[0])
+}
+
+// dnsRecord is a resource record in the update section of a dynamic update.
+type dnsRecord struct {
+	name   string
+	rrType uint16
+	class  uint16
+	ttl    uint32
+	data   []byte
+}
+
+// dhcidData returns the data of the DHCID record (RFC 4701) of the client of the given lease
+// with given FQDN. The client is identified by its client identifier if it has one,
+// otherwise by its hardware address.
+func dhcidData(l Lease, fqdn string) ([]byte, error) {
+	var idType uint16
+	var id []byte
+	if l.ClientID != "" {
+		clientID, err := parseHexBytes(l.ClientID)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		idType, id = dhcidTypeClientID, clientID
+	} else {
+		chAddr, err := net.ParseMAC(l.CHAddr)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		// Hardware type ethernet, followed by the hardware address
+		idType, id = dhcidTypeCHAddr, append([]byte{1}, chAddr...)
+	}
+	digest := sha256.New()
+	digest.Write(id)
+	digest.Write(encodeDomainName(fqdn))
+	data := appendUint16(nil, idType)
+	data = append(data, dhcidDigestSHA256)
+	return digest.Sum(data), nil
+}
+
+// dnsUpdateError is the error that is returned when the DNS server rejects a dynamic update.
+type dnsUpdateError struct {
+	zone  string
+	rcode int
+}
+
+func (e dnsUpdateError) Error() string {
+	return fmt.Sprintf("Update of zone '%s' failed with rcode %d", e.zone, e.rcode)
+}
+
+// isDNSRcode returns true if the given error is or is caused by a rejected
+// dynamic update with given response code.
+func isDNSRcode(err error, rcode int) bool {
+	e, ok := errors.Cause(err).(dnsUpdateError)
+	return ok && e.rcode == rcode
+}
+
+// send sends a dynamic update of the given zone with given prerequisites
+// and update records, and waits for the response.
+func (u *rfc2136DNSUpdater) send(zone string, prerequisites []dnsRecord, records ...dnsRecord) error {
+	id := uint16(rand.Intn(0x10000))
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsOpcodeUpdate<<11)
+	binary.BigEndian.PutUint16(msg[4:], 1) // Zone count
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(prerequisites)))
+	binary.BigEndian.PutUint16(msg[8:], uint16(len(records)))
+	// Zone section
+	msg = append(msg, encodeDomainName(zone)...)
+	msg = appendUint16(msg, dnsTypeSOA)
+	msg = appendUint16(msg, dnsClassIN)
+	// Prerequisite section
+	for _, r := range prerequisites {
+		msg = appendRecord(msg, encodeDomainName(r.name), r.rrType, r.class, 0, r.data)
+	}
+	// Update section
+	for _, r := range records {
+		msg = appendRecord(msg, encodeDomainName(r.name), r.rrType, r.class, r.ttl, r.data)
+	}
+	if u.tsig != nil {
+		msg = u.sign(msg, id)
+	}
+
+	conn, err := net.Dial("udp", u.server)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(dnsUpdateTimeout)); err != nil {
+		return maskAny(err)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return maskAny(err)
+	}
+	buffer := make([]byte, 512)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return maskAny(err)
+		}
+		if n < 12 || binary.BigEndian.Uint16(buffer) != id || buffer[2]&0x80 == 0 {
+			// Not a response to our update
+			continue
+		}
+		if rcode := buffer[3] & 0x0f; rcode != 0 {
+			return maskAny(dnsUpdateError{zone: zone, rcode: int(rcode)})
+		}
+		return nil
+	}
+}
+
+// sign appends a TSIG record to the given message (RFC 8945 section 4).
+func (u *rfc2136DNSUpdater) sign(msg []byte, id uint16) []byte {
+	algorithm := tsigAlgorithms[u.tsig.Algorithm]
+	keyName := encodeDomainName(u.tsig.Name)
+	algorithmName := encodeDomainName(algorithm.name)
+	now := uint64(time.Now().Unix())
+	timeSigned := []byte{byte(now >> 40), byte(now >> 32), byte(now >> 24), byte(now >> 16), byte(now >> 8), byte(now)}
+
+	// Compute the MAC over the message and the TSIG variables
+	mac := hmac.New(algorithm.hash, u.tsigSecret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write(appendUint32(appendUint16(nil, dnsClassANY), 0))
+	mac.Write(algorithmName)
+	mac.Write(timeSigned)
+	mac.Write(appendUint16(nil, tsigFudge))
+	mac.Write(appendUint16(appendUint16(nil, 0), 0)) // Error & other length
+	sum := mac.Sum(nil)
+
+	var data []byte
+	data = append(data, algorithmName...)
+	data = append(data, timeSigned...)
+	data = appendUint16(data, tsigFudge)
+	data = appendUint16(data, uint16(len(sum)))
+	data = append(data, sum...)
+	data = appendUint16(data, id)
+	data = appendUint16(data, 0) // Error
+	data = appendUint16(data, 0) // Other length
+
+	msg = appendRecord(msg, keyName, dnsTypeTSIG, dnsClassANY, 0, data)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1) // Additional count
+	return msg
+}
+
+// appendRecord appends a resource record to the given message.
+func appendRecord(msg, name []byte, rrType, class uint16, ttl uint32, data []byte) []byte {
+	msg = append(msg, name...)
+	msg = appendUint16(msg, rrType)
+	msg = appendUint16(msg, class)
+	msg = appendUint32(msg, ttl)
+	msg = appendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+func appendUint16(data []byte, v uint16) []byte {
+	return append(data, byte(v>>8), byte(v))
+}
+
+func appendUint32(data []byte, v uint32) []byte {
+	return append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// encodeDomainName encodes the given domain name in (uncompressed) wire format.
+func encodeDomainName(name string) []byte {
+	var data []byte
+	for _, label := range strings.Split(canonicalDomainName(name), ".") {
+		if label != "" {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+	}
+	return append(data, 0)
+}
+
+// canonicalDomainName returns the given domain name in lowercase without trailing dot.
+func canonicalDomainName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// reverseDomainName returns the name of the PTR record of the given IPv4 address.
+func reverseDomainName(ip net.IP) string {
+	ip4 := ip.To4()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+}
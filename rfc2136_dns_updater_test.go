@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDHCIDData(t *testing.T) {
+	// Example from RFC 4701 section 3.6
+	data, err := dhcidData(Lease{CHAddr: "01:02:03:04:05:06"}, "client.example.com")
+	if err != nil {
+		t.Fatalf("dhcidData failed: %v", err)
+	}
+	if encoded := base64.StdEncoding.EncodeToString(data); encoded != "AAABxLmlskllE0MVjd57zHcWmEH3pCQ6VytcKD//7es/deY=" {
+		t.Errorf("Unexpected DHCID, got %s", encoded)
+	}
+	// The client identifier takes precedence over the hardware address
+	data, err = dhcidData(Lease{CHAddr: "01:02:03:04:05:06", ClientID: "01:01:02:03:04:05:06"}, "client.example.com")
+	if err != nil {
+		t.Fatalf("dhcidData failed: %v", err)
+	}
+	if len(data) != 35 || data[0] != 0 || data[1] != dhcidTypeClientID || data[2] != dhcidDigestSHA256 {
+		t.Errorf("Unexpected DHCID, got %x", data)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+)
+
+// Server listens for DHCP requests and passes them on to the current handler.
+// The handler can be replaced at any time, without closing the listener.
+type Server struct {
+	mutex   sync.RWMutex
+	handler *DHCPHandler
+}
+
+// NewServer creates a new server without a handler.
+// Until a handler is set, all requests are ignored.
+func NewServer() *Server {
+	return &Server{}
+}
+
+// SetHandler replaces the handler used to serve requests.
+func (s *Server) SetHandler(h *DHCPHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handler = h
+}
+
+// Run the server until the given context is canceled.
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.ListenPacket("udp4", ":67")
+	if err != nil {
+		return maskAny(err)
+	}
+	defer l.Close()
+	conn := ipv4.NewPacketConn(l)
+	if err := conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		return maskAny(err)
+	}
+
+	go s.removeExpiredDNSRecords(ctx)
+
+	errors := make(chan error, 1)
+	go func() {
+		defer close(errors)
+		if err := s.serve(conn); err != nil {
+			errors <- err
+		}
+	}()
+
+	select {
+	case err := <-errors:
+		return maskAny(err)
+	case <-ctx.Done():
+		// Context closed
+		return nil
+	}
+}
+
+// removeExpiredDNSRecords periodically removes the DNS records of expired leases
+// using the current handler, until the given context is canceled.
+func (s *Server) removeExpiredDNSRecords(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(dnsCleanupInterval):
+			s.mutex.RLock()
+			h := s.handler
+			s.mutex.RUnlock()
+			if h != nil {
+				h.RemoveExpiredDNSRecords()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve reads DHCP packets from the given connection, passes them to the current
+// handler and sends back the responses, until reading or writing fails.
+// This is similar to dhcp.Serve, but it passes the receiving interface to the handler
+// and sends responses to the destination required by RFC 2131.
+func (s *Server) serve(conn *ipv4.PacketConn) error {
+	buffer := make([]byte, 1500)
+	for {
+		n, cm, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return maskAny(err)
+		}
+		if n < 240 { // Packet too small to be DHCP
+			continue
+		}
+		req := dhcp.Packet(buffer[:n])
+		if req.HLen() > 16 { // Invalid size
+			continue
+		}
+		options := req.ParseOptions()
+		var reqType dhcp.MessageType
+		if t := options[dhcp.OptionDHCPMessageType]; len(t) != 1 {
+			continue
+		} else {
+			reqType = dhcp.MessageType(t[0])
+			if reqType < dhcp.Discover || reqType > dhcp.Inform {
+				continue
+			}
+		}
+		var ifIndex int
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		if res := s.ServeDHCPIf(req, reqType, options, ifIndex); res != nil {
+			// Send direct responses out of the interface the request was received on.
+			// Relayed responses are routed normally.
+			var wcm *ipv4.ControlMessage
+			if ifIndex > 0 && req.GIAddr().Equal(net.IPv4zero) {
+				wcm = &ipv4.ControlMessage{IfIndex: ifIndex}
+			}
+			if _, err := conn.WriteTo(res, wcm, replyAddr(req, res, addr)); err != nil {
+				return maskAny(err)
+			}
+		}
+	}
+}
+
+// replyAddr returns the address to send the given response to, as described
+// in RFC 2131 section 4.1.
+func replyAddr(req, res dhcp.Packet, addr net.Addr) net.Addr {
+	if giAddr := req.GIAddr(); !giAddr.Equal(net.IPv4zero) {
+		// Relayed, send to the server port of the relay agent
+		return &net.UDPAddr{IP: copyIP(giAddr), Port: dhcpServerPort}
+	}
+	isNAK := false
+	if t := res.ParseOptions()[dhcp.OptionDHCPMessageType]; len(t) == 1 {
+		isNAK = dhcp.MessageType(t[0]) == dhcp.NAK
+	}
+	if ciAddr := req.CIAddr(); !ciAddr.Equal(net.IPv4zero) && !isNAK {
+		// Client has an address, unicast to it
+		return &net.UDPAddr{IP: copyIP(ciAddr), Port: dhcpClientPort}
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && !udpAddr.IP.Equal(net.IPv4zero) && !req.Broadcast() && !isNAK {
+		// Request came from a known address, reply to it
+		return addr
+	}
+	// Broadcast. Unicasting to yiaddr would require injecting an ARP entry,
+	// which we do not do.
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+}
+
+// ServeDHCPIf passes the request on to the current handler.
+func (s *Server) ServeDHCPIf(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options, ifIndex int) dhcp.Packet {
+	s.mutex.RLock()
+	h := s.handler
+	s.mutex.RUnlock()
+
+	if h == nil {
+		return nil
+	}
+	return h.ServeDHCPIf(p, msgType, options, ifIndex)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// SubnetConfig holds the configuration of a single network served by the server.
+type SubnetConfig struct {
+	// Subnet is the network in CIDR notation.
+	Subnet     string         `json:"subnet,omitempty"`
+	Ranges     []AddressRange `json:"ranges"`
+	Exclusions []AddressRange `json:"exclude,omitempty"`
+	Options    DHCPOptions    `json:"options"`
+	Boot       *BootConfig    `json:"boot,omitempty"`
+	// HostnameTemplate is used to create the hostname of clients without a reservation (e.g. "node-{ip-dashes}").
+	// If set, the created hostname is given to the client, instead of the hostname the client sent.
+	HostnameTemplate string `json:"hostname-template,omitempty"`
+	// Lease times of this subnet, overriding the global lease times.
+	LeaseTimes
+}
+
+// Validate changes the values in the given subnet.
+// Returns nil if all ok, otherwise an error.
+func (s *SubnetConfig) Validate() error {
+	_, subnet, err := net.ParseCIDR(s.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return maskAny(fmt.Errorf("Failed to parse subnet '%s'", s.Subnet))
+	}
+	s.Subnet = subnet.String()
+	if err := s.Options.Validate(); err != nil {
+		return maskAny(err)
+	}
+	if s.Options.SubnetMask != "" && !net.IP(subnet.Mask).Equal(parseIP(s.Options.SubnetMask)) {
+		return maskAny(fmt.Errorf("Subnet-mask option '%s' does not match subnet %s", s.Options.SubnetMask, subnet))
+	}
+	if err := s.Options.ValidateInSubnet(subnet); err != nil {
+		return maskAny(err)
+	}
+	if s.HostnameTemplate != "" {
+		if err := validateHostnameTemplate(s.HostnameTemplate); err != nil {
+			return maskAny(err)
+		}
+	}
+	if err := s.LeaseTimes.Validate(); err != nil {
+		return maskAny(err)
+	}
+	if s.Boot != nil {
+		if err := s.Boot.Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	for i := range s.Ranges {
+		r := &s.Ranges[i]
+		if err := r.Validate(); err != nil {
+			return maskAny(err)
+		}
+		if !subnet.Contains(r.First()) || !subnet.Contains(r.Last()) {
+			return maskAny(fmt.Errorf("Range '%s'-'%s' is not in subnet %s", r.Start, r.End, subnet))
+		}
+		if err := r.Options.ValidateInSubnet(subnet); err != nil {
+			return maskAny(err)
+		}
+	}
+	for i := range s.Exclusions {
+		r := &s.Exclusions[i]
+		if r.End == "" && r.Length == 0 {
+			// Single address
+			r.Length = 1
+		}
+		if err := r.Validate(); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// GetSubnet returns the network of this subnet.
+// The subnet must be validated before calling this function.
+func (s SubnetConfig) GetSubnet() *net.IPNet {
+	_, subnet, _ := net.ParseCIDR(s.Subnet)
+	return subnet
+}
+
+// Contains returns true when the given IP is part of this subnet.
+func (s SubnetConfig) Contains(ip net.IP) bool {
+	return s.GetSubnet().Contains(ip)
+}
+
+// IsInRange returns true when the given IP fits in one of the address ranges
+// of this subnet and is not excluded.
+func (s SubnetConfig) IsInRange(ip net.IP) bool {
+	if s.IsExcluded(ip) {
+		return false
+	}
+	for _, r := range s.Ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAvailableFor returns true when the given IP fits in one of the address ranges
+// of this subnet that can be used by a client with given relay agent information
+// and classes, and is not excluded.
+func (s SubnetConfig) IsAvailableFor(ip net.IP, info *RelayAgentInfo, classes []string) bool {
+	if s.IsExcluded(ip) {
+		return false
+	}
+	for _, r := range s.Ranges {
+		if r.Contains(ip) && r.AllowsClient(info, classes) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOptions returns the options for the given IP.
+// These are the options of the subnet, overridden by the options
+// of the range that contains the IP.
+func (s SubnetConfig) GetOptions(ip net.IP) DHCPOptions {
+	for _, r := range s.Ranges {
+		if r.Contains(ip) {
+			return s.Options.Merge(r.Options)
+		}
+	}
+	return s.Options
+}
+
+// GetLeaseTimes returns the lease times for the given IP.
+// These are the lease times of the subnet, overridden by the lease times
+// of the range that contains the IP.
+func (s SubnetConfig) GetLeaseTimes(ip net.IP) LeaseTimes {
+	for _, r := range s.Ranges {
+		if r.Contains(ip) {
+			return s.LeaseTimes.Merge(r.LeaseTimes)
+		}
+	}
+	return s.LeaseTimes
+}
+
+// IsExcluded returns true when the given IP must never be assigned dynamically.
+// This is the case for excluded addresses and the network and broadcast
+// addresses of the subnet.
+func (s SubnetConfig) IsExcluded(ip net.IP) bool {
+	subnet := s.GetSubnet()
+	if ip.Equal(subnet.IP) || ip.Equal(broadcastAddress(subnet)) {
+		return true
+	}
+	for _, r := range s.Exclusions {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
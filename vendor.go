@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// VendorSubOption is a sub-option of the vendor-specific information option (43),
+// with a typed value. The meaning of the sub-option codes is defined by the vendor.
+type VendorSubOption struct {
+	Code int `json:"code"` // Sub-option code
+	// Type of the value: ip, ip-list, uint8, uint16, uint32, bool, string, hex, routes or domain-list.
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Validate changes the values in the given sub-option.
+// Returns nil if all ok, otherwise an error.
+func (o *VendorSubOption) Validate() error {
+	if o.Code <= 0 || o.Code >= 255 {
+		return maskAny(fmt.Errorf("Vendor sub-option code must be between 1 and 254, got %d", o.Code))
+	}
+	if o.Type == "" {
+		return maskAny(fmt.Errorf("Vendor sub-option %d must have a type", o.Code))
+	}
+	data, err := o.Encode()
+	if err != nil {
+		return maskAny(fmt.Errorf("Invalid value for vendor sub-option %d: %v", o.Code, err))
+	}
+	if len(data) > maxOptionLength {
+		return maskAny(fmt.Errorf("Value of vendor sub-option %d is too long", o.Code))
+	}
+	return nil
+}
+
+// Encode returns the value of the sub-option.
+func (o VendorSubOption) Encode() ([]byte, error) {
+	return CustomOption{Code: o.Code, Type: o.Type, Value: o.Value}.Encode()
+}
+
+// validateVendorSubOptions checks the given sub-options and the size of
+// the vendor-specific information option they are encoded in.
+func validateVendorSubOptions(subOptions []VendorSubOption) error {
+	codes := make(map[int]struct{})
+	for i := range subOptions {
+		o := &subOptions[i]
+		if err := o.Validate(); err != nil {
+			return maskAny(err)
+		}
+		if _, found := codes[o.Code]; found {
+			return maskAny(fmt.Errorf("Duplicate vendor sub-option %d", o.Code))
+		}
+		codes[o.Code] = struct{}{}
+	}
+	if data, err := encodeVendorSubOptions(subOptions); err != nil {
+		return maskAny(err)
+	} else if len(data) > maxOptionLength {
+		return maskAny(fmt.Errorf("Vendor sub-options do not fit in a single option, got %d bytes", len(data)))
+	}
+	return nil
+}
+
+// encodeVendorSubOptions encodes the given sub-options as the value of the
+// vendor-specific information option (43).
+// Every sub-option is encoded as its code, the length of its value and its value (RFC 2132 section 8.4).
+func encodeVendorSubOptions(subOptions []VendorSubOption) ([]byte, error) {
+	var result []byte
+	for _, o := range subOptions {
+		data, err := o.Encode()
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		if len(data) > maxOptionLength {
+			return nil, maskAny(fmt.Errorf("Value of vendor sub-option %d is too long", o.Code))
+		}
+		result = append(result, byte(o.Code), byte(len(data)))
+		result = append(result, data...)
+	}
+	return result, nil
+}
+
+// mergeVendorSubOptions returns the given sub-options, with all sub-options
+// that have the same code as one of the given overrides replaced by that override.
+func mergeVendorSubOptions(subOptions, overrides []VendorSubOption) []VendorSubOption {
+	if len(overrides) == 0 {
+		return subOptions
+	}
+	result := make([]VendorSubOption, 0, len(subOptions)+len(overrides))
+	for _, o := range subOptions {
+		overridden := false
+		for _, override := range overrides {
+			if override.Code == o.Code {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result = append(result, o)
+		}
+	}
+	return append(result, overrides...)
+}